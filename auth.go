@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/config"
+)
+
+// AuthConfig authenticates the requests to a target. Username, password and
+// token files are read on every scrape, so that secrets can be rotated.
+type AuthConfig struct {
+	BasicAuth       *config.BasicAuth `yaml:"basic_auth"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+}
+
+func flagAuthConfig() AuthConfig {
+	var a AuthConfig
+	if *nginxUsername != "" || *nginxPasswordFile != "" {
+		a.BasicAuth = &config.BasicAuth{Username: *nginxUsername, PasswordFile: *nginxPasswordFile}
+	}
+	a.BearerTokenFile = *nginxBearerTokenFile
+	return a
+}
+
+func (a *AuthConfig) validate() error {
+	if a.BasicAuth != nil && a.BearerTokenFile != "" {
+		return errors.New("at most one of basic_auth and bearer_token_file must be configured")
+	}
+	if b := a.BasicAuth; b != nil {
+		if b.UsernameRef != "" || b.PasswordRef != "" {
+			return errors.New("basic_auth username_ref and password_ref are not supported")
+		}
+		if b.Username != "" && b.UsernameFile != "" {
+			return errors.New("at most one of basic_auth username and username_file must be configured")
+		}
+		if b.Password != "" && b.PasswordFile != "" {
+			return errors.New("at most one of basic_auth password and password_file must be configured")
+		}
+	}
+	return nil
+}
+
+// setDirectory joins the relative file paths with dir.
+func (a *AuthConfig) setDirectory(dir string) {
+	a.BasicAuth.SetDirectory(dir)
+	a.BearerTokenFile = config.JoinDir(dir, a.BearerTokenFile)
+}
+
+// roundTripper wraps rt, or http.DefaultTransport if nil, to authenticate
+// the requests.
+func (a AuthConfig) roundTripper(rt http.RoundTripper) http.RoundTripper {
+	if a.BasicAuth == nil && a.BearerTokenFile == "" {
+		return rt
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	if b := a.BasicAuth; b != nil {
+		return config.NewBasicAuthRoundTripper(secretReader(b.Username, b.UsernameFile), secretReader(string(b.Password), b.PasswordFile), rt)
+	}
+	return config.NewAuthorizationCredentialsRoundTripper("Bearer", config.NewFileSecret(a.BearerTokenFile), rt)
+}
+
+func secretReader(inline, file string) config.SecretReader {
+	if file != "" {
+		return config.NewFileSecret(file)
+	}
+	return config.NewInlineSecret(inline)
+}
+
+// headerFlags collects repeated -nginx.header "Name: value" flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	headers := make([]string, 0, len(h))
+	for _, name := range sortedKeys(h) {
+		headers = append(headers, name+": "+h[name])
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid header %q, must be \"Name: value\"", value)
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(v)
+	return nil
+}
+
+func (h headerFlags) headers() config.Headers {
+	headers := config.Headers{Headers: make(map[string]config.Header, len(h))}
+	for name, value := range h {
+		headers.Headers[name] = config.Header{Values: []string{value}}
+	}
+	return headers
+}
+
+// splitHost removes the Host entry from h and returns its value, as
+// net/http ignores a Host entry in the request headers.
+func splitHost(h *config.Headers) (string, error) {
+	for name, header := range h.Headers {
+		if http.CanonicalHeaderKey(name) != "Host" {
+			continue
+		}
+		delete(h.Headers, name)
+		if len(header.Values) != 1 || len(header.Secrets) > 0 || len(header.Files) > 0 {
+			return "", errors.New("the Host header takes a single entry in values")
+		}
+		return header.Values[0], nil
+	}
+	return "", nil
+}
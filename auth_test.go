@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/config"
+)
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthSecretRotation(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+
+	tests := []struct {
+		name string
+		auth AuthConfig
+		want func(secret string) string
+	}{
+		{
+			name: "basic auth password file",
+			auth: AuthConfig{BasicAuth: &config.BasicAuth{Username: "nginx", PasswordFile: secretFile}},
+			want: func(secret string) string { return basicAuth("nginx", secret) },
+		},
+		{
+			name: "basic auth username file",
+			auth: AuthConfig{BasicAuth: &config.BasicAuth{UsernameFile: secretFile, Password: "password"}},
+			want: func(secret string) string { return basicAuth(secret, "password") },
+		},
+		{
+			name: "bearer token file",
+			auth: AuthConfig{BearerTokenFile: secretFile},
+			want: func(secret string) string { return "Bearer " + secret },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nginx := newTestNginx(t, `{}`)
+			e := NewExporter("nginx", nginx.URL, nil)
+			e.Transport = tt.auth.roundTripper(nil)
+
+			// the file is read again on every scrape
+			for _, secret := range []string{"first", "rotated"} {
+				if err := os.WriteFile(secretFile, []byte(secret+"\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				scrapeLines(t, e)
+				r := <-nginx.received
+				if got, want := r.Header.Get("Authorization"), tt.want(secret); got != want {
+					t.Errorf("Authorization = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    AuthConfig
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "basic auth", auth: AuthConfig{BasicAuth: &config.BasicAuth{Username: "nginx", PasswordFile: "password"}}},
+		{name: "bearer token", auth: AuthConfig{BearerTokenFile: "token"}},
+		{name: "both", auth: AuthConfig{BasicAuth: &config.BasicAuth{Username: "nginx"}, BearerTokenFile: "token"}, wantErr: true},
+		{name: "username twice", auth: AuthConfig{BasicAuth: &config.BasicAuth{Username: "nginx", UsernameFile: "username"}}, wantErr: true},
+		{name: "password twice", auth: AuthConfig{BasicAuth: &config.BasicAuth{Password: "secret", PasswordFile: "password"}}, wantErr: true},
+		{name: "password ref", auth: AuthConfig{BasicAuth: &config.BasicAuth{PasswordRef: "password"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.auth.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantName  string
+		wantValue string
+		wantErr   bool
+	}{
+		{value: "Host: status.internal", wantName: "Host", wantValue: "status.internal"},
+		{value: "X-Tenant:a", wantName: "X-Tenant", wantValue: "a"},
+		{value: "X-Empty:", wantName: "X-Empty", wantValue: ""},
+		{value: "X-Url: http://a:80", wantName: "X-Url", wantValue: "http://a:80"},
+		{value: "X-Tenant", wantErr: true},
+		{value: " : a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			h := headerFlags{}
+			err := h.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if err == nil && (len(h) != 1 || h[tt.wantName] != tt.wantValue) {
+				t.Errorf("Set(%q) = %v, want %s: %q", tt.value, h, tt.wantName, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestHeaderFileRotation(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	nginx := newTestNginx(t, `{}`)
+	e := NewExporter("nginx", nginx.URL, nil)
+	e.Transport = config.NewHeadersRoundTripper(&config.Headers{Headers: map[string]config.Header{
+		"X-Status-Token": {Files: []string{tokenFile}},
+	}}, http.DefaultTransport)
+
+	// the file is read again on every scrape
+	for _, secret := range []string{"first", "rotated"} {
+		if err := os.WriteFile(tokenFile, []byte(secret+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		scrapeLines(t, e)
+		r := <-nginx.received
+		if got := r.Header.Get("X-Status-Token"); got != secret {
+			t.Errorf("X-Status-Token = %q, want %q", got, secret)
+		}
+	}
+}
+
+func TestSplitHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]config.Header
+		wantHost string
+		wantErr  bool
+	}{
+		{name: "none", headers: map[string]config.Header{"X-Tenant": {Values: []string{"a"}}}},
+		{name: "host", headers: map[string]config.Header{"host": {Values: []string{"status.internal"}}}, wantHost: "status.internal"},
+		{name: "host file", headers: map[string]config.Header{"Host": {Files: []string{"host"}}}, wantErr: true},
+		{name: "host twice", headers: map[string]config.Header{"Host": {Values: []string{"a", "b"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := config.Headers{Headers: tt.headers}
+			host, err := splitHost(&h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitHost() error = %v, want error %t", err, tt.wantErr)
+			}
+			if host != tt.wantHost {
+				t.Errorf("splitHost() = %q, want %q", host, tt.wantHost)
+			}
+			if err := h.Validate(); !tt.wantErr && err != nil {
+				t.Errorf("Validate() error = %v, want the Host entry removed", err)
+			}
+		})
+	}
+}
+
+func TestFetchHeaders(t *testing.T) {
+	nginx := newTestNginx(t, `{}`)
+	e := NewExporter("nginx", nginx.URL, nil)
+	headers := headerFlags{"host": "status.internal", "X-Tenant": "a"}.headers()
+	host, err := splitHost(&headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Host = host
+	e.Transport = config.NewHeadersRoundTripper(&headers, http.DefaultTransport)
+	scrapeLines(t, e)
+
+	r := <-nginx.received
+	if r.Host != "status.internal" {
+		t.Errorf("Host = %q, want status.internal", r.Host)
+	}
+	if got := r.Header.Get("X-Tenant"); got != "a" {
+		t.Errorf("X-Tenant = %q, want a", got)
+	}
+}
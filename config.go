@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the exporter configuration read from -config.file.
+type Config struct {
+	// Namespace overrides -metrics.namespace.
+	Namespace string `yaml:"namespace"`
+	// Zones overrides the -zones.* flags for all targets.
+	Zones   ZonesConfig    `yaml:"zones"`
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+// TargetConfig describes a single nginx vts status page to scrape.
+type TargetConfig struct {
+	// Name is exported as the target label, defaults to URL.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// SourceType is vts, stub_status or prometheus, defaults to
+	// -nginx.source_type.
+	SourceType string `yaml:"source_type"`
+	// PrometheusNamespace defaults to -nginx.prometheus_namespace, and
+	// RenameLabels renames the labels of the prometheus source type metrics
+	// that have no counterpart in the JSON format.
+	PrometheusNamespace string            `yaml:"prometheus_namespace"`
+	RenameLabels        map[string]string `yaml:"rename_labels"`
+	// JSONPCallback defaults to -nginx.jsonp_callback.
+	JSONPCallback string         `yaml:"jsonp_callback"`
+	Timeout       model.Duration `yaml:"timeout"`
+	// CacheTTL and PollInterval default to -nginx.cache_ttl and
+	// -nginx.poll_interval, 0s turns them off for the target.
+	CacheTTL     *model.Duration `yaml:"cache_ttl"`
+	PollInterval *model.Duration `yaml:"poll_interval"`
+	// DerivedMetrics defaults to -nginx.derived_metrics.
+	DerivedMetrics *bool            `yaml:"derived_metrics"`
+	TLSConfig      config.TLSConfig `yaml:"tls_config"`
+	// Headers are sent with every request, values given in files are read
+	// on every scrape. A Host header overrides the request host.
+	Headers    config.Headers `yaml:"headers"`
+	AuthConfig `yaml:",inline"`
+	// Labels are static labels added to every metric of the target.
+	Labels map[string]string `yaml:"labels"`
+
+	host string
+}
+
+func loadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{Zones: flagZonesConfig()}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+
+	if cfg.Namespace == "" {
+		cfg.Namespace = *metricsNamespace
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("%s: no targets configured", filename)
+	}
+
+	names := make(map[string]bool, len(cfg.Targets))
+	stdinTargets := 0
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if t.URL == "" {
+			return nil, fmt.Errorf("%s: target %d has no url", filename, i)
+		}
+		if t.URL == stdinURI {
+			if !*oneshot {
+				return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, errStdinWithoutOneshot)
+			}
+			// targets are collected concurrently, so they would split stdin
+			if stdinTargets++; stdinTargets > 1 {
+				return nil, fmt.Errorf("%s: %w", filename, errStdinTwice)
+			}
+		}
+		if t.Name == "" {
+			t.Name = t.URL
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: duplicate target name %q", filename, t.Name)
+		}
+		names[t.Name] = true
+
+		if t.SourceType == "" {
+			t.SourceType = *nginxSourceType
+		}
+		if err := validateSourceType(t.SourceType); err != nil {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, err)
+		}
+		if t.PrometheusNamespace == "" {
+			t.PrometheusNamespace = *nginxPrometheusNamespace
+		}
+		for _, name := range t.RenameLabels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("%s: target %q has invalid label name %q in rename_labels", filename, t.Name, name)
+			}
+		}
+		if t.JSONPCallback == "" {
+			t.JSONPCallback = *nginxJSONPCallback
+		}
+		if t.CacheTTL == nil {
+			ttl := model.Duration(*nginxCacheTTL)
+			t.CacheTTL = &ttl
+		}
+		if t.PollInterval == nil {
+			interval := model.Duration(*nginxPollInterval)
+			t.PollInterval = &interval
+		}
+		if t.DerivedMetrics == nil {
+			derived := *derivedMetrics
+			t.DerivedMetrics = &derived
+		}
+		if *t.DerivedMetrics && *t.PollInterval == 0 {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, errDerivedWithoutPolling)
+		}
+		if *t.DerivedMetrics && t.SourceType != sourceVts {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, errDerivedWithoutVts)
+		}
+		if t.Timeout == 0 {
+			t.Timeout = model.Duration(time.Duration(*nginxScrapeTimeout) * time.Second)
+		}
+		for name := range t.Labels {
+			if !model.LabelName(name).IsValid() || name == "target" {
+				return nil, fmt.Errorf("%s: target %q has invalid label name %q", filename, t.Name, name)
+			}
+		}
+		// a static label named like a variable label of a metric would make
+		// every collection of the target panic
+		labels := prometheus.Labels{"target": t.Name}
+		for name, value := range t.Labels {
+			labels[name] = value
+		}
+		if err := prometheus.NewRegistry().Register(NewExporter(cfg.Namespace, t.URL, labels)); err != nil {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, err)
+		}
+		if err := t.AuthConfig.validate(); err != nil {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, err)
+		}
+		host, err := splitHost(&t.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, err)
+		}
+		t.host = host
+		if err := t.Headers.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: target %q: %w", filename, t.Name, err)
+		}
+		t.TLSConfig.SetDirectory(filepath.Dir(filename))
+		t.AuthConfig.setDirectory(filepath.Dir(filename))
+		t.Headers.SetDirectory(filepath.Dir(filename))
+	}
+
+	return cfg, nil
+}
+
+// targetsCollector scrapes every configured target concurrently.
+type targetsCollector []*Exporter
+
+func newTargetsCollector(cfg *Config, zoneFilters map[string]*zoneFilter) (targetsCollector, error) {
+	// Metrics of the same name must share label names, so a static label
+	// missing from a target is exported with an empty value.
+	var labelNames []string
+	seen := map[string]bool{}
+	for _, t := range cfg.Targets {
+		for name := range t.Labels {
+			if !seen[name] {
+				seen[name] = true
+				labelNames = append(labelNames, name)
+			}
+		}
+	}
+	sort.Strings(labelNames)
+
+	targets := make(targetsCollector, 0, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		constLabels := prometheus.Labels{"target": t.Name}
+		for _, name := range labelNames {
+			constLabels[name] = t.Labels[name]
+		}
+
+		transport, err := newTransport(t.URL, t.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+
+		e := NewExporter(cfg.Namespace, t.URL, constLabels)
+		e.SourceType = t.SourceType
+		e.JSONPCallback = t.JSONPCallback
+		e.PrometheusNamespace = t.PrometheusNamespace
+		e.RenameLabels = t.RenameLabels
+		e.Timeout = time.Duration(t.Timeout)
+		e.CacheTTL = time.Duration(*t.CacheTTL)
+		e.PollInterval = time.Duration(*t.PollInterval)
+		e.DerivedMetrics = *t.DerivedMetrics
+		e.Host = t.host
+		e.Transport = config.NewHeadersRoundTripper(&t.Headers, t.AuthConfig.roundTripper(transport))
+		e.ZoneFilters = zoneFilters
+		targets = append(targets, e)
+	}
+
+	return targets, nil
+}
+
+// startPolling starts polling the targets, doing their first polls
+// concurrently.
+func (t targetsCollector) startPolling() {
+	var wg sync.WaitGroup
+	for _, e := range t {
+		wg.Add(1)
+		go func(e *Exporter) {
+			defer wg.Done()
+			e.startPolling()
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (t targetsCollector) stopPolling() {
+	for _, e := range t {
+		e.stopPolling()
+	}
+}
+
+func (t targetsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, e := range t {
+		e.Describe(ch)
+	}
+}
+
+func (t targetsCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, e := range t {
+		wg.Add(1)
+		go func(e *Exporter) {
+			defer wg.Done()
+			e.Collect(ch)
+		}(e)
+	}
+	wg.Wait()
+}
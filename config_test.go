@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigStdin(t *testing.T) {
+	tests := []struct {
+		config  string
+		oneshot bool
+		wantErr error
+	}{
+		{config: "targets:\n  - url: \"-\"\n", oneshot: false, wantErr: errStdinWithoutOneshot},
+		{config: "targets:\n  - url: \"-\"\n", oneshot: true},
+		{config: "targets:\n  - url: \"-\"\n  - url: http://a/status\n", oneshot: true},
+		{config: "targets:\n  - name: a\n    url: \"-\"\n  - name: b\n    url: \"-\"\n", oneshot: true, wantErr: errStdinTwice},
+	}
+
+	for _, tt := range tests {
+		setVar(t, oneshot, tt.oneshot)
+		_, err := loadConfig(writeConfig(t, tt.config))
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("oneshot=%t, %q: loadConfig() error = %v, want %v", tt.oneshot, tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigDerived(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr error
+	}{
+		{config: "targets:\n  - url: http://a/status\n    poll_interval: 5s\n    derived_metrics: true\n"},
+		{config: "targets:\n  - url: http://a/status\n    derived_metrics: true\n", wantErr: errDerivedWithoutPolling},
+		{config: "targets:\n  - url: http://a/status\n    source_type: stub_status\n    poll_interval: 5s\n    derived_metrics: true\n", wantErr: errDerivedWithoutVts},
+		{config: "targets:\n  - url: http://a/status\n    source_type: prometheus\n    poll_interval: 5s\n    derived_metrics: true\n", wantErr: errDerivedWithoutVts},
+		{config: "targets:\n  - url: http://a/status\n    source_type: stub_status\n    poll_interval: 5s\n"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadConfig(writeConfig(t, tt.config))
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%q: loadConfig() error = %v, want %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := writeConfig(t, `targets:
+  - name: defaults
+    url: http://a/status
+  - name: off
+    url: http://b/status
+    cache_ttl: 0s
+    poll_interval: 0s
+    derived_metrics: false
+  - name: on
+    url: http://c/status
+    cache_ttl: 1s
+    poll_interval: 2s
+`)
+
+	savedTTL, savedInterval, savedDerived := *nginxCacheTTL, *nginxPollInterval, *derivedMetrics
+	defer func() { *nginxCacheTTL, *nginxPollInterval, *derivedMetrics = savedTTL, savedInterval, savedDerived }()
+	*nginxCacheTTL, *nginxPollInterval, *derivedMetrics = 10*time.Second, 5*time.Second, true
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cacheTTL, pollInterval time.Duration
+		derived                bool
+	}{
+		{cacheTTL: 10 * time.Second, pollInterval: 5 * time.Second, derived: true},
+		{},
+		{cacheTTL: time.Second, pollInterval: 2 * time.Second, derived: true},
+	}
+	for i, tt := range tests {
+		target := cfg.Targets[i]
+		if got := time.Duration(*target.CacheTTL); got != tt.cacheTTL {
+			t.Errorf("%s: cache_ttl = %v, want %v", target.Name, got, tt.cacheTTL)
+		}
+		if got := time.Duration(*target.PollInterval); got != tt.pollInterval {
+			t.Errorf("%s: poll_interval = %v, want %v", target.Name, got, tt.pollInterval)
+		}
+		if *target.DerivedMetrics != tt.derived {
+			t.Errorf("%s: derived_metrics = %t, want %t", target.Name, *target.DerivedMetrics, tt.derived)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "no targets",
+			config:  "targets: []\n",
+			wantErr: "no targets configured",
+		},
+		{
+			name:    "no url",
+			config:  "targets:\n  - name: a\n",
+			wantErr: "has no url",
+		},
+		{
+			name:    "duplicate target name",
+			config:  "targets:\n  - name: edge\n    url: http://a/status\n  - name: edge\n    url: http://b/status\n",
+			wantErr: `duplicate target name "edge"`,
+		},
+		{
+			name:    "duplicate default target name",
+			config:  "targets:\n  - url: http://a/status\n  - url: http://a/status\n",
+			wantErr: "duplicate target name",
+		},
+		{
+			name:    "reserved target label",
+			config:  "targets:\n  - url: http://a/status\n    labels:\n      target: edge\n",
+			wantErr: `invalid label name "target"`,
+		},
+		{
+			name:    "invalid label name",
+			config:  "targets:\n  - url: http://a/status\n    labels:\n      0dc: east\n",
+			wantErr: `invalid label name "0dc"`,
+		},
+		{
+			name:    "static label named like a variable label",
+			config:  "targets:\n  - url: http://a/status\n    labels:\n      host: edge\n",
+			wantErr: "duplicate label names",
+		},
+		{
+			name:    "static label named like an upstream label",
+			config:  "targets:\n  - url: http://a/status\n    labels:\n      backend: edge\n",
+			wantErr: "duplicate label names",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTargetsCollectorLabels(t *testing.T) {
+	nginx := newTestNginx(t, `{"serverZones": {"a": {"requestCounter": 1}}}`)
+	path := writeConfig(t, `targets:
+  - name: edge-1
+    url: `+nginx.URL+`
+    labels:
+      dc: east
+  - url: `+nginx.URL+`
+    labels:
+      rack: r1
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Targets[1].Name; got != nginx.URL {
+		t.Errorf("default target name = %q, want the url %q", got, nginx.URL)
+	}
+	targets, err := newTargetsCollector(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both targets get the union of the static labels
+	lines := scrapeLines(t, targets)
+	for _, want := range []string{
+		`nginx_server_requests{code="total",dc="east",host="a",rack="",target="edge-1"} 1`,
+		`nginx_server_requests{code="total",dc="",host="a",rack="r1",target="` + nginx.URL + `"} 1`,
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// decodeVts decodes the vts JSON read from r zone by zone, sending the
+// metrics of each zone to ch as soon as it is read instead of holding the
+// whole NginxVts in memory. Each kind of zone is decoded into a single
+// value, reusing its bucket arrays, since the metrics do not keep them. On
+// error, the metrics of the zones read so far have been sent already. The
+// zones of kinds with a limit are kept until the end, since the limit takes
+// them in name order. JSONP is read whole to strip its callback.
+func (e *Exporter) decodeVts(ch chan<- prometheus.Metric, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if !startsWithObject(br) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		var nginxVtx NginxVts
+		if err := json.Unmarshal(stripJSONP(data, e.JSONPCallback), &nginxVtx); err != nil {
+			return err
+		}
+		e.collectVts(ch, &nginxVtx, true)
+		return nil
+	}
+
+	// nginxVtx only holds the top level fields and the limited zone kinds
+	var nginxVtx NginxVts
+	dec := json.NewDecoder(br)
+	err := decodeObject(dec, func(key string) error {
+		switch key {
+		case "hostName":
+			return dec.Decode(&nginxVtx.HostName)
+		case "nginxVersion":
+			return dec.Decode(&nginxVtx.NginxVersion)
+		case "loadMsec":
+			return dec.Decode(&nginxVtx.LoadMsec)
+		case "nowMsec":
+			return dec.Decode(&nginxVtx.NowMsec)
+		case "connections":
+			return dec.Decode(&nginxVtx.Connections)
+		case "sharedZones":
+			return dec.Decode(&nginxVtx.SharedZones)
+		case "serverZones":
+			if e.limited(kindServer) {
+				return dec.Decode(&nginxVtx.ServerZones)
+			}
+			var s Server
+			return decodeObject(dec, func(host string) error {
+				s = Server{RequestBuckets: s.RequestBuckets.reuse()}
+				if err := dec.Decode(&s); err != nil {
+					return err
+				}
+				if e.keepZone(kindServer, host) {
+					e.collectServer(ch, host, s)
+				}
+				return nil
+			})
+		case "upstreamZones":
+			if e.limited(kindUpstream) {
+				return dec.Decode(&nginxVtx.UpstreamZones)
+			}
+			var backends []Upstream
+			return decodeObject(dec, func(name string) error {
+				backends = nil
+				if err := dec.Decode(&backends); err != nil {
+					return err
+				}
+				if e.keepZone(kindUpstream, name) {
+					for _, s := range backends {
+						e.collectUpstream(ch, name, s.Server, s)
+						e.collectUpstreamPeer(ch, name, s)
+					}
+				}
+				return nil
+			})
+		case "filterZones":
+			if e.limited(kindFilter) {
+				return dec.Decode(&nginxVtx.FilterZones)
+			}
+			var s Upstream
+			return decodeObject(dec, func(filter string) error {
+				return decodeObject(dec, func(name string) error {
+					s = Upstream{RequestBuckets: s.RequestBuckets.reuse()}
+					if err := dec.Decode(&s); err != nil {
+						return err
+					}
+					if e.keepZone(kindFilter, filter+"::"+name) {
+						e.collectFilter(ch, filter, name, s)
+					}
+					return nil
+				})
+			})
+		case "cacheZones":
+			if e.limited(kindCache) {
+				return dec.Decode(&nginxVtx.CacheZones)
+			}
+			var s Cache
+			return decodeObject(dec, func(zone string) error {
+				s = Cache{}
+				if err := dec.Decode(&s); err != nil {
+					return err
+				}
+				if e.keepZone(kindCache, zone) {
+					e.collectCache(ch, zone, s)
+				}
+				return nil
+			})
+		case "streamServerZones":
+			var s StreamServer
+			return decodeObject(dec, func(listen string) error {
+				s = StreamServer{SessionBuckets: s.SessionBuckets.reuse()}
+				if err := dec.Decode(&s); err != nil {
+					return err
+				}
+				e.collectStreamServer(ch, listen, s)
+				return nil
+			})
+		case "streamUpstreamZones":
+			var backends []StreamUpstream
+			return decodeObject(dec, func(name string) error {
+				backends = nil
+				if err := dec.Decode(&backends); err != nil {
+					return err
+				}
+				for _, s := range backends {
+					e.collectStreamUpstream(ch, name, s)
+				}
+				return nil
+			})
+		case "streamFilterZones":
+			if e.limited(kindStreamFilter) {
+				return dec.Decode(&nginxVtx.StreamFilterZones)
+			}
+			var s StreamUpstream
+			return decodeObject(dec, func(filter string) error {
+				return decodeObject(dec, func(name string) error {
+					s = StreamUpstream{SessionBuckets: s.SessionBuckets.reuse()}
+					if err := dec.Decode(&s); err != nil {
+						return err
+					}
+					if e.keepZone(kindStreamFilter, filter+"::"+name) {
+						e.collectStreamFilter(ch, filter, name, s)
+					}
+					return nil
+				})
+			})
+		default:
+			var skip json.RawMessage
+			return dec.Decode(&skip)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	e.collectVts(ch, &nginxVtx, true)
+	return nil
+}
+
+// reuse returns b emptied, keeping its arrays for the next decode.
+func (b Buckets) reuse() Buckets {
+	return Buckets{Msecs: b.Msecs[:0], Counters: b.Counters[:0]}
+}
+
+// limited reports whether the zones of kind have a limit.
+func (e *Exporter) limited(kind string) bool {
+	f := e.ZoneFilters[kind]
+	return f != nil && f.limit > 0
+}
+
+// startsWithObject reports whether the next non-space byte of r opens a
+// JSON object, leaving it unread.
+func startsWithObject(r *bufio.Reader) bool {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		r.UnreadByte()
+		return c == '{'
+	}
+}
+
+// decodeObject calls fn with each key of the JSON object read by dec, fn
+// decoding the value. A null object has no keys.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("expected JSON object, got %v", t)
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := fn(t.(string)); err != nil {
+			return err
+		}
+	}
+
+	// the closing brace
+	_, err = dec.Token()
+	return err
+}
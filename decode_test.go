@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// vtsFixture returns a vts status page with n server zones and n/10
+// upstream, filter and cache zones and stream server, upstream and filter
+// zones.
+func vtsFixture(tb testing.TB, n int) []byte {
+	tb.Helper()
+	// zones alternate between bucket sets, so that a zone decoded after
+	// another does not keep its buckets
+	bucketSets := []Buckets{
+		{Msecs: []uint64{5, 10, 50, 100, 500}, Counters: []uint64{1, 2, 3, 4, 5}},
+		{Msecs: []uint64{10, 100}, Counters: []uint64{7, 8}},
+		{},
+	}
+
+	v := NginxVts{
+		HostName:      "nginx-1",
+		NginxVersion:  "1.25.3",
+		LoadMsec:      1700000000000,
+		NowMsec:       1700000100000,
+		ServerZones:   map[string]Server{},
+		UpstreamZones: map[string][]Upstream{},
+		FilterZones:   map[string]map[string]Upstream{},
+		CacheZones:    map[string]Cache{},
+
+		StreamServerZones:   map[string]StreamServer{},
+		StreamUpstreamZones: map[string][]StreamUpstream{},
+		StreamFilterZones:   map[string]map[string]StreamUpstream{},
+	}
+	for i := 0; i < n; i++ {
+		buckets := bucketSets[i%len(bucketSets)]
+		s := Server{RequestCounter: uint64(i), InBytes: uint64(10 * i), OutBytes: uint64(100 * i), RequestBuckets: buckets}
+		s.Responses.TwoXx = uint64(i)
+		s.OverCounts.MaxIntegerSize = 18446744073709551615
+		v.ServerZones[fmt.Sprintf("host-%05d.example.com", i)] = s
+	}
+	for i := 0; i < n/10; i++ {
+		buckets := bucketSets[i%len(bucketSets)]
+		u := Upstream{RequestCounter: uint64(i), Weight: 1, MaxFails: 1, FailTimeout: 10, RequestBuckets: buckets}
+		u.OverCounts.MaxIntegerSize = 18446744073709551615
+		name := fmt.Sprintf("upstream-%04d", i)
+		for j := 0; j < 2; j++ {
+			u.Server = fmt.Sprintf("10.0.%d.%d:80", i/250, j)
+			v.UpstreamZones[name] = append(v.UpstreamZones[name], u)
+		}
+		filter := fmt.Sprintf("filter-%d", i%10)
+		if v.FilterZones[filter] == nil {
+			v.FilterZones[filter] = map[string]Upstream{}
+		}
+		v.FilterZones[filter][fmt.Sprintf("name-%04d", i)] = u
+		v.CacheZones[fmt.Sprintf("cache-%04d", i)] = Cache{MaxSize: 1 << 20, UsedSize: uint64(i)}
+
+		su := StreamUpstream{Server: fmt.Sprintf("10.1.%d.%d:53", i/250, i%250), ConnectCounter: uint64(i), SessionBuckets: buckets}
+		su.OverCounts.MaxIntegerSize = 18446744073709551615
+		v.StreamServerZones[fmt.Sprintf("TCP:%d:0.0.0.0", 1000+i)] = StreamServer{Port: uint64(1000 + i), Protocol: "TCP", ConnectCounter: uint64(i), SessionBuckets: buckets, OverCounts: su.OverCounts}
+		v.StreamUpstreamZones[fmt.Sprintf("stream-%04d", i)] = []StreamUpstream{su}
+		if v.StreamFilterZones[filter] == nil {
+			v.StreamFilterZones[filter] = map[string]StreamUpstream{}
+		}
+		v.StreamFilterZones[filter][fmt.Sprintf("name-%04d", i)] = su
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// decodeUnmarshal is the decoding of vts JSON before decodeVts, reading
+// the whole page into an NginxVts.
+func (e *Exporter) decodeUnmarshal(ch chan<- prometheus.Metric, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var nginxVtx NginxVts
+	if err := json.Unmarshal(data, &nginxVtx); err != nil {
+		return err
+	}
+	e.collectVts(ch, &nginxVtx, true)
+	return nil
+}
+
+// metricStrings returns the sorted descriptions and values of metrics.
+func metricStrings(t *testing.T, metrics []prometheus.Metric) []string {
+	t.Helper()
+	lines := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		// counters created at different times are still the same metric
+		if pb.Counter != nil {
+			pb.Counter.CreatedTimestamp = nil
+		}
+		lines = append(lines, m.Desc().String()+" "+pb.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestDecodeVtsEquivalence(t *testing.T) {
+	data := vtsFixture(t, 500)
+
+	tests := []struct {
+		name string
+		cfg  ZonesConfig
+	}{
+		{name: "all zones", cfg: ZonesConfig{LimitAction: limitDrop}},
+		{name: "filtered", cfg: ZonesConfig{
+			LimitAction:  limitDrop,
+			Server:       ZoneFilterConfig{Include: `host-00[0-2].*`, Exclude: `.*7\.example\.com`},
+			Upstream:     ZoneFilterConfig{Exclude: `upstream-000.`},
+			Filter:       ZoneFilterConfig{Include: `filter-[1-3]::.*`},
+			Cache:        ZoneFilterConfig{Exclude: `.*`},
+			StreamFilter: ZoneFilterConfig{Include: `filter-[4-6]::.*`},
+		}},
+		{name: "limit drop", cfg: ZonesConfig{
+			LimitAction:  limitDrop,
+			Server:       ZoneFilterConfig{Limit: 100},
+			Upstream:     ZoneFilterConfig{Limit: 10},
+			Filter:       ZoneFilterConfig{Limit: 10},
+			Cache:        ZoneFilterConfig{Limit: 10},
+			StreamFilter: ZoneFilterConfig{Limit: 10},
+		}},
+		{name: "limit fold", cfg: ZonesConfig{
+			LimitAction:  limitFold,
+			Server:       ZoneFilterConfig{Include: `host-00.*`, Limit: 10},
+			Filter:       ZoneFilterConfig{Limit: 10},
+			StreamFilter: ZoneFilterConfig{Limit: 10},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters, err := newZoneFilters(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var errs [2]error
+			decoders := []func(*Exporter) func(chan<- prometheus.Metric, io.Reader) error{
+				func(e *Exporter) func(chan<- prometheus.Metric, io.Reader) error { return e.decodeVts },
+				func(e *Exporter) func(chan<- prometheus.Metric, io.Reader) error { return e.decodeUnmarshal },
+			}
+			var got [2][]string
+			var dropped [2][]string
+			for i, decoder := range decoders {
+				e := NewExporter("nginx", "", nil)
+				e.ZoneFilters = filters
+				decode := decoder(e)
+				got[i] = metricStrings(t, bufferMetrics(func(ch chan<- prometheus.Metric) {
+					errs[i] = decode(ch, bytes.NewReader(data))
+				}))
+				dropped[i] = metricStrings(t, bufferMetrics(e.droppedZones.Collect))
+				if errs[i] != nil {
+					t.Fatal(errs[i])
+				}
+			}
+
+			if len(got[0]) == 0 {
+				t.Fatal("no metrics decoded")
+			}
+			if strings.Join(got[0], "\n") != strings.Join(got[1], "\n") {
+				t.Errorf("decodeVts exported %d metrics, unmarshaling %d", len(got[0]), len(got[1]))
+				for i := 0; i < len(got[0]) && i < len(got[1]); i++ {
+					if got[0][i] != got[1][i] {
+						t.Errorf("first difference:\n%s\n%s", got[0][i], got[1][i])
+						break
+					}
+				}
+			}
+			if strings.Join(dropped[0], "\n") != strings.Join(dropped[1], "\n") {
+				t.Errorf("dropped zones differ:\n%v\n%v", dropped[0], dropped[1])
+			}
+		})
+	}
+}
+
+func TestDecodeVtsBucketsNotKept(t *testing.T) {
+	// the second zone has no buckets, as from a vts without histograms
+	const page = `{"serverZones": {
+		"a": {"requestCounter": 2, "requestBuckets": {"msecs": [10], "counters": [2]}},
+		"b": {"requestCounter": 1}
+	}}`
+
+	e := NewExporter("nginx", "", nil)
+	lines := metricStrings(t, bufferMetrics(func(ch chan<- prometheus.Metric) {
+		if err := e.decodeVts(ch, strings.NewReader(page)); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	histograms := 0
+	for _, line := range lines {
+		if strings.Contains(line, "request_duration_seconds") {
+			histograms++
+		}
+	}
+	if histograms != 1 {
+		t.Errorf("got %d request duration histograms, want 1:\n%s", histograms, strings.Join(lines, "\n"))
+	}
+}
+
+func TestScrapeTruncated(t *testing.T) {
+	const page = `{"hostName": "nginx-1", "serverZones": {"a": {"requestCounter": 1}, "b": {"requestCounter": 2}}}`
+	truncated := page[:strings.Index(page, `"b"`)]
+
+	tests := []struct {
+		name        string
+		body        string
+		maxBodySize int64
+		cacheTTL    time.Duration
+		want        []string
+		wantStage   string
+	}{
+		{
+			name:      "truncated",
+			body:      truncated,
+			want:      []string{`nginx_server_requests{code="total",host="a"} 1`},
+			wantStage: stageDecode,
+		},
+		{
+			name:      "truncated cached",
+			body:      truncated,
+			cacheTTL:  time.Minute,
+			want:      []string{`nginx_server_requests{code="total",host="a"} 1`},
+			wantStage: stageDecode,
+		},
+		{name: "too large", body: page, maxBodySize: int64(len(truncated)), wantStage: stageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := fixtureExporter(t, tt.body)
+			e.MaxBodySize = tt.maxBodySize
+			e.CacheTTL = tt.cacheTTL
+
+			// the second collection is served from the cache with a TTL
+			for i := 1; i <= 2; i++ {
+				errors := i
+				if tt.cacheTTL > 0 {
+					errors = 1
+				}
+				lines := scrapeLines(t, e)
+				want := append([]string{"nginx_up 0", fmt.Sprintf(`nginx_exporter_scrape_errors_total{stage=%q} %d`, tt.wantStage, errors)}, tt.want...)
+				for _, want := range want {
+					if !hasSample(lines, want) {
+						t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+					}
+				}
+				// zones past the truncation and the page totals are missing
+				for _, absent := range []string{`nginx_server_requests{code="total",host="b"}`, "nginx_server_info"} {
+					if hasSample(lines, absent) {
+						t.Errorf("unexpected %s", absent)
+					}
+				}
+			}
+		})
+	}
+}
+
+// peakHeap runs fn and returns by how much the heap grew at most meanwhile,
+// sampled every 100µs.
+func peakHeap(fn func()) uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	runtime.GC()
+	metrics.Read(sample)
+	base := sample[0].Value.Uint64()
+
+	stop := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		s := []metrics.Sample{{Name: sample[0].Name}}
+		for {
+			metrics.Read(s)
+			if v := s[0].Value.Uint64(); v > max {
+				max = v
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+		}
+	}()
+	fn()
+	close(stop)
+	if max := <-peak; max > base {
+		return max - base
+	}
+	return 0
+}
+
+// BenchmarkScrape compares collecting a page with 10k server zones with
+// reading and unmarshaling the whole page before collecting it, reporting
+// the peak heap growth of a collection. Most allocations are the metrics,
+// the same either way, so streaming saves few allocations but a lot of heap.
+func BenchmarkScrape(b *testing.B) {
+	data := vtsFixture(b, 10000)
+	path := filepath.Join(b.TempDir(), "status.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		b.Fatal(err)
+	}
+	uri := fileScheme + path
+
+	for _, bm := range []struct {
+		name    string
+		collect func(e *Exporter, ch chan<- prometheus.Metric)
+	}{
+		{name: "stream", collect: (*Exporter).Collect},
+		{name: "unmarshal", collect: func(e *Exporter, ch chan<- prometheus.Metric) {
+			body, err := e.fetch()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer body.Close()
+			if err := e.decodeUnmarshal(ch, body); err != nil {
+				b.Fatal(err)
+			}
+		}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			e := NewExporter("nginx", uri, nil)
+			ch := make(chan prometheus.Metric, 1024)
+			done := make(chan struct{})
+			go func() {
+				for range ch {
+				}
+				close(done)
+			}()
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				if p := peakHeap(func() { bm.collect(e, ch) }); p > peak {
+					peak = p
+				}
+			}
+			close(ch)
+			<-done
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errDerivedWithoutPolling = errors.New("derived metrics require a poll interval")
+	errDerivedWithoutVts     = errors.New("derived metrics require the vts source type")
+)
+
+// zoneCounters are the counters of a zone that rates are derived from.
+type zoneCounters struct {
+	requests, errors, inBytes, outBytes, requestMsec float64
+}
+
+func serverCounters(s Server) zoneCounters {
+	o := s.OverCounts
+	return zoneCounters{
+		requests:    counterValue(s.RequestCounter, o.RequestCounter, o.MaxIntegerSize),
+		errors:      counterValue(s.Responses.FiveXx, o.FiveXx, o.MaxIntegerSize),
+		inBytes:     counterValue(s.InBytes, o.InBytes, o.MaxIntegerSize),
+		outBytes:    counterValue(s.OutBytes, o.OutBytes, o.MaxIntegerSize),
+		requestMsec: counterValue(s.RequestMsecCounter, o.RequestMsecCounter, o.MaxIntegerSize),
+	}
+}
+
+func upstreamCounters(s Upstream) zoneCounters {
+	o := s.OverCounts
+	return zoneCounters{
+		requests:    counterValue(s.RequestCounter, o.RequestCounter, o.MaxIntegerSize),
+		errors:      counterValue(s.Responses.FiveXx, o.FiveXx, o.MaxIntegerSize),
+		inBytes:     counterValue(s.InBytes, o.InBytes, o.MaxIntegerSize),
+		outBytes:    counterValue(s.OutBytes, o.OutBytes, o.MaxIntegerSize),
+		requestMsec: counterValue(s.RequestMsecCounter, o.RequestMsecCounter, o.MaxIntegerSize),
+	}
+}
+
+// collectDerived sends the request rate, 5xx ratio, average latency and
+// throughput of the server, upstream and filter zones over the interval
+// between two polls. Zones whose counters went down, e.g. after a restart
+// of nginx, are skipped until the next poll. Zones are selected like
+// collectVts does, but zones folded into __other__ get no derived metrics.
+func (e *Exporter) collectDerived(ch chan<- prometheus.Metric, prev, cur *snapshot) {
+	seconds := cur.time.Sub(prev.time).Seconds()
+	// the vts clock is more accurate than the poll times
+	if cur.vts.NowMsec > prev.vts.NowMsec && prev.vts.NowMsec > 0 {
+		seconds = float64(time.Duration(cur.vts.NowMsec-prev.vts.NowMsec)*time.Millisecond) / float64(time.Second)
+	}
+	if seconds <= 0 {
+		return
+	}
+
+	hosts, _ := e.selectZones(kindServer, sortedKeys(cur.vts.ServerZones), false)
+	for _, host := range hosts {
+		if p, ok := prev.vts.ServerZones[host]; ok {
+			e.collectRates(ch, e.serverMetrics, serverCounters(p), serverCounters(cur.vts.ServerZones[host]), seconds, host)
+		}
+	}
+
+	names, _ := e.selectZones(kindUpstream, sortedKeys(cur.vts.UpstreamZones), false)
+	for _, name := range names {
+		for _, s := range cur.vts.UpstreamZones[name] {
+			for _, p := range prev.vts.UpstreamZones[name] {
+				if p.Server == s.Server {
+					e.collectRates(ch, e.upstreamMetrics, upstreamCounters(p), upstreamCounters(s), seconds, name, s.Server)
+					break
+				}
+			}
+		}
+	}
+
+	filterZones := filterZoneNames(cur.vts.FilterZones)
+	keys, _ := e.selectZones(kindFilter, sortedKeys(filterZones), false)
+	for _, key := range keys {
+		filter, name := filterZones[key][0], filterZones[key][1]
+		if p, ok := prev.vts.FilterZones[filter][name]; ok {
+			e.collectRates(ch, e.filterMetrics, upstreamCounters(p), upstreamCounters(cur.vts.FilterZones[filter][name]), seconds, filter, name)
+		}
+	}
+}
+
+func (e *Exporter) collectRates(ch chan<- prometheus.Metric, metrics map[string]*prometheus.Desc, prev, cur zoneCounters, seconds float64, labels ...string) {
+	if cur.requests < prev.requests || cur.errors < prev.errors || cur.inBytes < prev.inBytes || cur.outBytes < prev.outBytes || cur.requestMsec < prev.requestMsec {
+		return
+	}
+
+	requests := cur.requests - prev.requests
+	errorRatio, latency := 0.0, 0.0
+	if requests > 0 {
+		errorRatio = (cur.errors - prev.errors) / requests
+		latency = (cur.requestMsec - prev.requestMsec) / requests / 1000
+	}
+
+	ch <- prometheus.MustNewConstMetric(metrics["requestsPerSecond"], prometheus.GaugeValue, requests/seconds, labels...)
+	ch <- prometheus.MustNewConstMetric(metrics["errorRatio"], prometheus.GaugeValue, errorRatio, labels...)
+	// vts builds without requestMsecCounter report no request times at all
+	if cur.requestMsec > 0 || prev.requestMsec > 0 {
+		ch <- prometheus.MustNewConstMetric(metrics["requestLatency"], prometheus.GaugeValue, latency, labels...)
+	}
+	ch <- prometheus.MustNewConstMetric(metrics["bytesPerSecond"], prometheus.GaugeValue, (cur.inBytes-prev.inBytes)/seconds, append(labels, "in")...)
+	ch <- prometheus.MustNewConstMetric(metrics["bytesPerSecond"], prometheus.GaugeValue, (cur.outBytes-prev.outBytes)/seconds, append(labels, "out")...)
+}
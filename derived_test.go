@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectFunc is an unchecked collector sending the metrics of a function.
+type collectFunc func(ch chan<- prometheus.Metric)
+
+func (f collectFunc) Describe(chan<- *prometheus.Desc) {}
+
+func (f collectFunc) Collect(ch chan<- prometheus.Metric) { f(ch) }
+
+func testServer(requests, fiveXx, inBytes, outBytes, requestMsec uint64) Server {
+	var s Server
+	s.RequestCounter, s.Responses.FiveXx, s.InBytes, s.OutBytes, s.RequestMsecCounter = requests, fiveXx, inBytes, outBytes, requestMsec
+	return s
+}
+
+func testUpstream(server string, requests, fiveXx, inBytes, outBytes, requestMsec uint64) Upstream {
+	var s Upstream
+	s.Server = server
+	s.RequestCounter, s.Responses.FiveXx, s.InBytes, s.OutBytes, s.RequestMsecCounter = requests, fiveXx, inBytes, outBytes, requestMsec
+	return s
+}
+
+func TestCollectDerived(t *testing.T) {
+	wrapped := testServer(10, 0, 0, 0, 0)
+	wrapped.OverCounts.MaxIntegerSize, wrapped.OverCounts.RequestCounter = 4294967295, 1
+
+	tests := []struct {
+		name      string
+		zones     ZonesConfig
+		prev, cur *NginxVts
+		// pollGap is the time between the polls
+		pollGap time.Duration
+		want    []string
+	}{
+		{
+			name:    "server rates over the nowMsec interval",
+			prev:    &NginxVts{NowMsec: 1000, ServerZones: map[string]Server{"a": testServer(100, 10, 1000, 5000, 2000)}},
+			cur:     &NginxVts{NowMsec: 11000, ServerZones: map[string]Server{"a": testServer(600, 60, 6000, 30000, 12000)}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_server_bytes_per_second{direction="in",host="a"} 500`,
+				`nginx_server_bytes_per_second{direction="out",host="a"} 2500`,
+				`nginx_server_error_ratio{host="a"} 0.1`,
+				`nginx_server_request_latency_seconds{host="a"} 0.02`,
+				`nginx_server_requests_per_second{host="a"} 50`,
+			},
+		},
+		{
+			name:    "poll interval without nowMsec",
+			prev:    &NginxVts{ServerZones: map[string]Server{"a": testServer(0, 0, 0, 0, 0)}},
+			cur:     &NginxVts{ServerZones: map[string]Server{"a": testServer(10, 0, 0, 0, 0)}},
+			pollGap: 2 * time.Second,
+			want: []string{
+				`nginx_server_bytes_per_second{direction="in",host="a"} 0`,
+				`nginx_server_bytes_per_second{direction="out",host="a"} 0`,
+				`nginx_server_error_ratio{host="a"} 0`,
+				`nginx_server_requests_per_second{host="a"} 5`,
+			},
+		},
+		{
+			name:    "no requests",
+			prev:    &NginxVts{NowMsec: 1000, ServerZones: map[string]Server{"a": testServer(5, 1, 0, 0, 100)}},
+			cur:     &NginxVts{NowMsec: 2000, ServerZones: map[string]Server{"a": testServer(5, 1, 0, 0, 100)}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_server_bytes_per_second{direction="in",host="a"} 0`,
+				`nginx_server_bytes_per_second{direction="out",host="a"} 0`,
+				`nginx_server_error_ratio{host="a"} 0`,
+				`nginx_server_request_latency_seconds{host="a"} 0`,
+				`nginx_server_requests_per_second{host="a"} 0`,
+			},
+		},
+		{
+			name:    "wrapped counter",
+			prev:    &NginxVts{NowMsec: 1000, ServerZones: map[string]Server{"a": testServer(4294967290, 0, 0, 0, 0)}},
+			cur:     &NginxVts{NowMsec: 11000, ServerZones: map[string]Server{"a": wrapped}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_server_bytes_per_second{direction="in",host="a"} 0`,
+				`nginx_server_bytes_per_second{direction="out",host="a"} 0`,
+				`nginx_server_error_ratio{host="a"} 0`,
+				// 4294967290 to 10 plus one wrap of maxIntegerSize, see counterValue
+				`nginx_server_requests_per_second{host="a"} 1.5`,
+			},
+		},
+		{
+			name: "counters went down after a restart",
+			prev: &NginxVts{NowMsec: 1000, ServerZones: map[string]Server{
+				"a": testServer(100, 0, 0, 0, 0),
+				"b": testServer(100, 0, 0, 0, 0),
+			}},
+			cur: &NginxVts{NowMsec: 2000, ServerZones: map[string]Server{
+				"a": testServer(5, 0, 0, 0, 0),
+				"b": testServer(101, 0, 0, 0, 0),
+			}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_server_bytes_per_second{direction="in",host="b"} 0`,
+				`nginx_server_bytes_per_second{direction="out",host="b"} 0`,
+				`nginx_server_error_ratio{host="b"} 0`,
+				`nginx_server_requests_per_second{host="b"} 1`,
+			},
+		},
+		{
+			name:    "new zone",
+			prev:    &NginxVts{NowMsec: 1000, ServerZones: map[string]Server{}},
+			cur:     &NginxVts{NowMsec: 2000, ServerZones: map[string]Server{"a": testServer(1, 0, 0, 0, 0)}},
+			pollGap: time.Second,
+		},
+		{
+			name: "upstream backends matched by server",
+			prev: &NginxVts{NowMsec: 1000, UpstreamZones: map[string][]Upstream{"backend": {
+				testUpstream("10.0.0.1:80", 10, 0, 0, 0, 0),
+				testUpstream("10.0.0.2:80", 20, 0, 0, 0, 0),
+			}}},
+			cur: &NginxVts{NowMsec: 11000, UpstreamZones: map[string][]Upstream{"backend": {
+				testUpstream("10.0.0.2:80", 40, 2, 0, 0, 0),
+				testUpstream("10.0.0.3:80", 5, 0, 0, 0, 0),
+				testUpstream("10.0.0.1:80", 30, 0, 100, 0, 1000),
+			}}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_upstream_bytes_per_second{backend="10.0.0.1:80",direction="in",upstream="backend"} 10`,
+				`nginx_upstream_bytes_per_second{backend="10.0.0.1:80",direction="out",upstream="backend"} 0`,
+				`nginx_upstream_bytes_per_second{backend="10.0.0.2:80",direction="in",upstream="backend"} 0`,
+				`nginx_upstream_bytes_per_second{backend="10.0.0.2:80",direction="out",upstream="backend"} 0`,
+				`nginx_upstream_error_ratio{backend="10.0.0.1:80",upstream="backend"} 0`,
+				`nginx_upstream_error_ratio{backend="10.0.0.2:80",upstream="backend"} 0.1`,
+				`nginx_upstream_request_latency_seconds{backend="10.0.0.1:80",upstream="backend"} 0.05`,
+				`nginx_upstream_requests_per_second{backend="10.0.0.1:80",upstream="backend"} 2`,
+				`nginx_upstream_requests_per_second{backend="10.0.0.2:80",upstream="backend"} 2`,
+			},
+		},
+		{
+			name:    "filter zones",
+			prev:    &NginxVts{NowMsec: 1000, FilterZones: map[string]map[string]Upstream{"country": {"US": testUpstream("", 10, 0, 0, 0, 0)}}},
+			cur:     &NginxVts{NowMsec: 3000, FilterZones: map[string]map[string]Upstream{"country": {"US": testUpstream("", 20, 5, 0, 0, 0)}}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_filter_bytes_per_second{direction="in",filter="country",filterName="US"} 0`,
+				`nginx_filter_bytes_per_second{direction="out",filter="country",filterName="US"} 0`,
+				`nginx_filter_error_ratio{filter="country",filterName="US"} 0.5`,
+				`nginx_filter_requests_per_second{filter="country",filterName="US"} 5`,
+			},
+		},
+		{
+			name:  "zone filters and folded zones",
+			zones: ZonesConfig{LimitAction: limitFold, Server: ZoneFilterConfig{Exclude: "a", Limit: 1}},
+			prev: &NginxVts{NowMsec: 1000, ServerZones: map[string]Server{
+				"a": testServer(0, 0, 0, 0, 0),
+				"b": testServer(0, 0, 0, 0, 0),
+				"c": testServer(0, 0, 0, 0, 0),
+			}},
+			cur: &NginxVts{NowMsec: 2000, ServerZones: map[string]Server{
+				"a": testServer(1, 0, 0, 0, 0),
+				"b": testServer(2, 0, 0, 0, 0),
+				"c": testServer(3, 0, 0, 0, 0),
+			}},
+			pollGap: time.Second,
+			want: []string{
+				`nginx_server_bytes_per_second{direction="in",host="b"} 0`,
+				`nginx_server_bytes_per_second{direction="out",host="b"} 0`,
+				`nginx_server_error_ratio{host="b"} 0`,
+				`nginx_server_requests_per_second{host="b"} 2`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.zones.LimitAction == "" {
+				tt.zones.LimitAction = limitDrop
+			}
+			filters, err := newZoneFilters(tt.zones)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := NewExporter("nginx", "", nil)
+			e.ZoneFilters = filters
+
+			now := time.Now()
+			prev := &snapshot{vts: tt.prev, time: now.Add(-tt.pollGap)}
+			cur := &snapshot{vts: tt.cur, time: now}
+			got := scrapeLines(t, collectFunc(func(ch chan<- prometheus.Metric) {
+				e.collectDerived(ch, prev, cur)
+			}))
+
+			sort.Strings(got)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("derived metrics:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/config"
+)
+
+const (
+	unixScheme = "unix://"
+	fileScheme = "file://"
+	// stdinURI reads the vts JSON from standard input.
+	stdinURI = "-"
+)
+
+// errStdinWithoutOneshot is returned for the stdin URI outside of -oneshot,
+// where every scrape after the first would find stdin drained.
+var errStdinWithoutOneshot = errors.New("reading the status from stdin (-) requires -oneshot")
+
+// errStdinTwice is returned for more than one stdin target, which would each
+// read part of it.
+var errStdinTwice = errors.New("at most one target can read the status from stdin (-)")
+
+// fetch returns the vts status read from e.URI, which is an http(s)://,
+// unix:// or file:// URI, or - for standard input.
+func (e *Exporter) fetch() (io.ReadCloser, error) {
+	switch {
+	case e.URI == stdinURI:
+		return io.NopCloser(os.Stdin), nil
+	case strings.HasPrefix(e.URI, fileScheme):
+		return os.Open(strings.TrimPrefix(e.URI, fileScheme))
+	default:
+		return e.fetchHTTP()
+	}
+}
+
+// parseUnixURI splits a unix:///path/to/socket:/status/format/json URI
+// into the socket path and the request path.
+func parseUnixURI(uri string) (socket, path string, ok bool) {
+	if !strings.HasPrefix(uri, unixScheme) {
+		return "", "", false
+	}
+	socket, path, _ = strings.Cut(strings.TrimPrefix(uri, unixScheme), ":")
+	if path == "" {
+		path = "/"
+	}
+	return socket, path, true
+}
+
+// newTransport returns a dedicated transport to scrape uri, dialing the
+// socket of unix:// URIs. CA, certificate and key files are reloaded when
+// they change.
+func newTransport(uri string, tlsConfig config.TLSConfig) (http.RoundTripper, error) {
+	var opts []config.HTTPClientOption
+	if socket, _, ok := parseUnixURI(uri); ok {
+		opts = append(opts, config.WithDialContextFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}))
+	}
+
+	return config.NewRoundTripperFromConfig(config.HTTPClientConfig{
+		TLSConfig:   tlsConfig,
+		EnableHTTP2: true,
+		ProxyConfig: config.ProxyConfig{ProxyFromEnvironment: true},
+	}, "nginx_vts_exporter", opts...)
+}
+
+// optionalBool is a boolean flag that is nil until it is set.
+type optionalBool struct {
+	value *bool
+}
+
+func (b *optionalBool) String() string {
+	if b == nil || b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.value)
+}
+
+func (b *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value = &v
+	return nil
+}
+
+func (b *optionalBool) IsBoolFlag() bool { return true }
+
+// flagTLSConfig returns the TLS settings given by the -nginx.tls.* flags and
+// -insecure. The certificate is verified whenever a -nginx.tls.* flag is set,
+// unless -insecure is passed explicitly.
+func flagTLSConfig() (config.TLSConfig, error) {
+	cfg := config.TLSConfig{
+		CAFile:     *nginxTLSCAFile,
+		CertFile:   *nginxTLSCertFile,
+		KeyFile:    *nginxTLSKeyFile,
+		ServerName: *nginxTLSServerName,
+	}
+	tlsFlags := cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" || cfg.ServerName != "" || *nginxTLSMinVersion != ""
+	cfg.InsecureSkipVerify = !tlsFlags
+	if insecure.value != nil {
+		cfg.InsecureSkipVerify = *insecure.value
+	}
+	if *nginxTLSMinVersion != "" {
+		version, ok := config.TLSVersions[*nginxTLSMinVersion]
+		if !ok {
+			return cfg, fmt.Errorf("unknown TLS version %q", *nginxTLSMinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	return cfg, cfg.Validate()
+}
+
+func (e *Exporter) fetchHTTP() (io.ReadCloser, error) {
+	client := &http.Client{Transport: e.Transport, Timeout: e.Timeout}
+
+	uri := e.URI
+	if _, path, ok := parseUnixURI(uri); ok {
+		uri = "http://unix" + path
+	}
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if e.Host != "" {
+		req.Host = e.Host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return decodeBody(resp)
+}
+
+// decodeBody decodes the body of resp according to its Content-Encoding.
+// Setting Accept-Encoding turns off the transparent gzip support of
+// http.Transport, so this also covers gzip.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	var r io.Reader
+	var err error
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip":
+		r, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		r, err = zlib.NewReader(resp.Body)
+	default:
+		err = fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return decodedBody{Reader: r, Closer: resp.Body}, nil
+}
+
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+var errBodyTooLarge = errors.New("status page too large")
+
+// bodyReader reads the status page, failing with errBodyTooLarge beyond
+// limit bytes unless limit is 0. It records read errors, so that they can be
+// told apart from decode errors.
+type bodyReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	err   error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.limit > 0 && int64(len(p)) > b.limit-b.n+1 {
+		p = p[:b.limit-b.n+1]
+	}
+
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.limit > 0 && b.n > b.limit {
+		b.err = fmt.Errorf("%w, exceeds %d bytes", errBodyTooLarge, b.limit)
+		return 0, b.err
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// stage returns the scrape error stage of err, returned while decoding
+// the body.
+func (b *bodyReader) stage(err error) string {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return stageTooLarge
+	case b.err != nil:
+		return stageRead
+	default:
+		return stageDecode
+	}
+}
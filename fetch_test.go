@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/prometheus/common/config"
+)
+
+func TestParseUnixURI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantSocket string
+		wantPath   string
+		wantOK     bool
+	}{
+		{uri: "unix:///run/nginx/status.sock:/status/format/json", wantSocket: "/run/nginx/status.sock", wantPath: "/status/format/json", wantOK: true},
+		{uri: "unix:///run/nginx/status.sock", wantSocket: "/run/nginx/status.sock", wantPath: "/", wantOK: true},
+		{uri: "unix:///run/nginx/status.sock:/status?format=json", wantSocket: "/run/nginx/status.sock", wantPath: "/status?format=json", wantOK: true},
+		{uri: "http://localhost/status"},
+		{uri: "file:///tmp/status.json"},
+		{uri: "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			socket, path, ok := parseUnixURI(tt.uri)
+			if socket != tt.wantSocket || path != tt.wantPath || ok != tt.wantOK {
+				t.Errorf("parseUnixURI() = %q, %q, %t, want %q, %q, %t", socket, path, ok, tt.wantSocket, tt.wantPath, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFetchUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "status.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip("unix sockets not supported:", err)
+	}
+	paths := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		_, _ = w.Write([]byte(`{"serverZones": {"a": {"requestCounter": 3}}}`))
+	})}
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	uri := unixScheme + socket + ":/status/format/json"
+	transport, err := newTransport(uri, config.TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter("nginx", uri, nil)
+	e.Transport = transport
+	lines := scrapeLines(t, e)
+
+	if gotPath := <-paths; gotPath != "/status/format/json" {
+		t.Errorf("requested path %q, want /status/format/json", gotPath)
+	}
+	for _, want := range []string{"nginx_up 1", `nginx_server_requests{code="total",host="a"} 3`} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func compress(t *testing.T, encoding, data string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "deflate":
+		w = zlib.NewWriter(&b)
+	default:
+		return []byte(data)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	const status = `{"hostName": "nginx-1"}`
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{encoding: "", body: []byte(status)},
+		{encoding: "identity", body: []byte(status)},
+		{encoding: "gzip", body: compress(t, "gzip", status)},
+		{encoding: "GZIP", body: compress(t, "gzip", status)},
+		{encoding: "deflate", body: compress(t, "deflate", status)},
+		{encoding: "gzip", body: []byte(status), wantErr: true},
+		{encoding: "deflate", body: []byte(status), wantErr: true},
+		{encoding: "br", body: []byte(status), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{"Content-Encoding": []string{tt.encoding}},
+				Body:   io.NopCloser(bytes.NewReader(tt.body)),
+			}
+			body, err := decodeBody(resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBody() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer body.Close()
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != status {
+				t.Errorf("decoded body = %q, want %q", data, status)
+			}
+		})
+	}
+}
+
+func TestBodyReader(t *testing.T) {
+	errBroken := errors.New("connection reset")
+
+	tests := []struct {
+		name      string
+		r         io.Reader
+		limit     int64
+		wantData  string
+		wantStage string
+	}{
+		{name: "unlimited", r: strings.NewReader("0123456789"), wantData: "0123456789"},
+		{name: "below limit", r: strings.NewReader("0123456789"), limit: 11, wantData: "0123456789"},
+		{name: "at limit", r: strings.NewReader("0123456789"), limit: 10, wantData: "0123456789"},
+		{name: "above limit", r: strings.NewReader("0123456789"), limit: 9, wantStage: stageTooLarge},
+		{name: "read error", r: io.MultiReader(strings.NewReader("01"), iotest.ErrReader(errBroken)), wantStage: stageRead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bodyReader{r: tt.r, limit: tt.limit}
+			data, err := io.ReadAll(b)
+			if tt.wantStage == "" {
+				if err != nil {
+					t.Fatalf("read error = %v", err)
+				}
+				if string(data) != tt.wantData {
+					t.Errorf("read %q, want %q", data, tt.wantData)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("read succeeded")
+			}
+			if stage := b.stage(err); stage != tt.wantStage {
+				t.Errorf("stage(%v) = %s, want %s", err, stage, tt.wantStage)
+			}
+		})
+	}
+
+	// errors of the decoder itself are decode errors
+	b := &bodyReader{r: strings.NewReader("{}")}
+	if stage := b.stage(errors.New("invalid character")); stage != stageDecode {
+		t.Errorf("stage() = %s, want %s", stage, stageDecode)
+	}
+}
+
+func TestFetchCompressed(t *testing.T) {
+	const status = `{"serverZones": {"a": {"requestCounter": 3}}}`
+
+	tests := []struct {
+		name        string
+		encoding    string
+		maxBodySize int64
+		wantUp      bool
+		wantStage   string
+	}{
+		{name: "gzip", encoding: "gzip", wantUp: true},
+		{name: "deflate", encoding: "deflate", wantUp: true},
+		// the limit applies to the decoded body
+		{name: "gzip above limit", encoding: "gzip", maxBodySize: int64(len(status)) - 1, wantStage: stageTooLarge},
+		{name: "gzip at limit", encoding: "gzip", maxBodySize: int64(len(status)), wantUp: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := compress(t, tt.encoding, status)
+			nginx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.Header.Get("Accept-Encoding"), tt.encoding) {
+					t.Errorf("Accept-Encoding %q does not offer %s", r.Header.Get("Accept-Encoding"), tt.encoding)
+				}
+				w.Header().Set("Content-Encoding", tt.encoding)
+				_, _ = w.Write(body)
+			}))
+			defer nginx.Close()
+
+			e := NewExporter("nginx", nginx.URL, nil)
+			e.MaxBodySize = tt.maxBodySize
+			lines := scrapeLines(t, e)
+
+			if tt.wantUp {
+				for _, want := range []string{"nginx_up 1", `nginx_server_requests{code="total",host="a"} 3`} {
+					if !hasSample(lines, want) {
+						t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+					}
+				}
+				return
+			}
+			for _, want := range []string{"nginx_up 0", `nginx_exporter_scrape_errors_total{stage="` + tt.wantStage + `"} 1`} {
+				if !hasSample(lines, want) {
+					t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestFlagTLSConfigInsecure(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name       string
+		serverName string
+		insecure   *bool
+		want       bool
+	}{
+		{name: "defaults", want: true},
+		{name: "secure", insecure: &no, want: false},
+		{name: "tls flag", serverName: "status.internal", want: false},
+		{name: "tls flag and insecure", serverName: "status.internal", insecure: &yes, want: true},
+		{name: "tls flag and secure", serverName: "status.internal", insecure: &no, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, nginxTLSServerName, tt.serverName)
+			setVar(t, &insecure.value, tt.insecure)
+
+			cfg, err := flagTLSConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.InsecureSkipVerify != tt.want {
+				t.Errorf("InsecureSkipVerify = %t, want %t", cfg.InsecureSkipVerify, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionalBoolFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b := &optionalBool{}
+	fs.Var(b, "insecure", "")
+	if err := fs.Parse(nil); err != nil || b.value != nil {
+		t.Fatalf("unset flag = %v, %v, want nil", b.value, err)
+	}
+	if err := fs.Parse([]string{"-insecure=false"}); err != nil || b.value == nil || *b.value {
+		t.Errorf("-insecure=false = %v, %v", b, err)
+	}
+	if err := fs.Parse([]string{"-insecure"}); err != nil || b.value == nil || !*b.value {
+		t.Errorf("-insecure = %v, %v", b, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// testNginx serves body, or fails with 500 while fail is set. The first
+// requests are sent to received.
+type testNginx struct {
+	*httptest.Server
+	fail     atomic.Bool
+	requests atomic.Int64
+	received chan *http.Request
+}
+
+func newTestNginx(t testing.TB, body string) *testNginx {
+	t.Helper()
+	n := &testNginx{received: make(chan *http.Request, 10)}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.requests.Add(1)
+		select {
+		case n.received <- r:
+		default:
+		}
+		if n.fail.Load() {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+// fixtureExporter returns an exporter scraping body from a test server.
+func fixtureExporter(t *testing.T, body string) *Exporter {
+	t.Helper()
+	return NewExporter("nginx", newTestNginx(t, body).URL, nil)
+}
+
+// setVar sets *p to v for the duration of the test.
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// scrapeLines collects c once and returns the sample lines of the text
+// format, without comments.
+func scrapeLines(t *testing.T, c prometheus.Collector) []string {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&b, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// hasSample reports whether lines has a sample starting with prefix, i.e.
+// a metric name with its labels, optionally followed by the value.
+func hasSample(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleValue returns the value of the sample of lines named name,
+// including its labels.
+func sampleValue(lines []string, name string) (string, bool) {
+	for _, line := range lines {
+		if value, ok := strings.CutPrefix(line, name+" "); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,22 @@
+package main
+
+import "bytes"
+
+// stripJSONP unwraps the output of /status/format/jsonp, which vts wraps in
+// a call to callback:
+//
+//	ngx_http_vhost_traffic_status_jsonp({...});
+//
+// Data not wrapped in callback is returned unchanged.
+func stripJSONP(data []byte, callback string) []byte {
+	if callback == "" {
+		return data
+	}
+
+	body, ok := bytes.CutPrefix(bytes.TrimSpace(data), []byte(callback))
+	body = bytes.TrimSpace(bytes.TrimSuffix(bytes.TrimSpace(body), []byte(";")))
+	if !ok || len(body) < 2 || body[0] != '(' || body[len(body)-1] != ')' {
+		return data
+	}
+	return body[1 : len(body)-1]
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripJSONP(t *testing.T) {
+	const callback = "ngx_http_vhost_traffic_status_jsonp"
+
+	tests := []struct {
+		name     string
+		data     string
+		callback string
+		want     string
+	}{
+		{
+			name:     "vts output",
+			data:     callback + `({"hostName": "nginx-1"});`,
+			callback: callback,
+			want:     `{"hostName": "nginx-1"}`,
+		},
+		{
+			name:     "whitespace and no semicolon",
+			data:     "\n  " + callback + ` ( {"a": "(b)"} ) ` + "\n",
+			callback: callback,
+			want:     ` {"a": "(b)"} `,
+		},
+		{
+			name:     "custom callback",
+			data:     `cb({});`,
+			callback: "cb",
+			want:     `{}`,
+		},
+		{
+			name:     "plain json",
+			data:     `{"hostName": "nginx-1"}`,
+			callback: callback,
+			want:     `{"hostName": "nginx-1"}`,
+		},
+		{
+			name:     "other callback",
+			data:     `other({});`,
+			callback: callback,
+			want:     `other({});`,
+		},
+		{
+			name:     "unterminated call",
+			data:     callback + `({}`,
+			callback: callback,
+			want:     callback + `({}`,
+		},
+		{
+			name:     "stripping disabled",
+			data:     callback + `({});`,
+			callback: "",
+			want:     callback + `({});`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(stripJSONP([]byte(tt.data), tt.callback)); got != tt.want {
+				t.Errorf("stripJSONP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectJSONP(t *testing.T) {
+	e := fixtureExporter(t, `ngx_http_vhost_traffic_status_jsonp({"hostName": "nginx-1", "nginxVersion": "1.25.0", "serverZones": {"a": {"requestCounter": 3}}});`)
+	lines := scrapeLines(t, e)
+
+	for _, want := range []string{
+		"nginx_up 1",
+		`nginx_server_info{hostName="nginx-1",nginxVersion="1.25.0"}`,
+		`nginx_server_requests{code="total",host="a"} 3`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-kod/kod"
@@ -17,26 +21,21 @@ import (
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	cversion "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+	"golang.org/x/sync/singleflight"
 )
 
 //go:generate go run github.com/go-kod/kod/cmd/kod generate .
 
 type NginxVts struct {
-	HostName     string `json:"hostName"`
-	NginxVersion string `json:"nginxVersion"`
-	LoadMsec     int64  `json:"loadMsec"`
-	NowMsec      int64  `json:"nowMsec"`
-	Connections  struct {
-		Active   uint64 `json:"active"`
-		Reading  uint64 `json:"reading"`
-		Writing  uint64 `json:"writing"`
-		Waiting  uint64 `json:"waiting"`
-		Accepted uint64 `json:"accepted"`
-		Handled  uint64 `json:"handled"`
-		Requests uint64 `json:"requests"`
-	} `json:"connections"`
-	SharedZones struct {
+	HostName     string      `json:"hostName"`
+	NginxVersion string      `json:"nginxVersion"`
+	LoadMsec     int64       `json:"loadMsec"`
+	NowMsec      int64       `json:"nowMsec"`
+	Connections  Connections `json:"connections"`
+	SharedZones  struct {
 		Name     string `json:"name"`
 		MaxSize  uint64 `json:"maxSize"`
 		UsedSize uint64 `json:"usedSize"`
@@ -46,14 +45,30 @@ type NginxVts struct {
 	UpstreamZones map[string][]Upstream          `json:"upstreamZones"`
 	FilterZones   map[string]map[string]Upstream `json:"filterZones"`
 	CacheZones    map[string]Cache               `json:"cacheZones"`
+	// Stream zones are reported by nginx-module-sts.
+	StreamServerZones   map[string]StreamServer              `json:"streamServerZones"`
+	StreamUpstreamZones map[string][]StreamUpstream          `json:"streamUpstreamZones"`
+	StreamFilterZones   map[string]map[string]StreamUpstream `json:"streamFilterZones"`
+}
+
+type Connections struct {
+	Active   uint64 `json:"active"`
+	Reading  uint64 `json:"reading"`
+	Writing  uint64 `json:"writing"`
+	Waiting  uint64 `json:"waiting"`
+	Accepted uint64 `json:"accepted"`
+	Handled  uint64 `json:"handled"`
+	Requests uint64 `json:"requests"`
 }
 
 type Server struct {
-	RequestCounter uint64 `json:"requestCounter"`
-	InBytes        uint64 `json:"inBytes"`
-	OutBytes       uint64 `json:"outBytes"`
-	RequestMsec    uint64 `json:"requestMsec"`
-	Responses      struct {
+	RequestCounter     uint64  `json:"requestCounter"`
+	InBytes            uint64  `json:"inBytes"`
+	OutBytes           uint64  `json:"outBytes"`
+	RequestMsecCounter uint64  `json:"requestMsecCounter"`
+	RequestMsec        uint64  `json:"requestMsec"`
+	RequestBuckets     Buckets `json:"requestBuckets"`
+	Responses          struct {
 		OneXx       uint64 `json:"1xx"`
 		TwoXx       uint64 `json:"2xx"`
 		ThreeXx     uint64 `json:"3xx"`
@@ -69,23 +84,24 @@ type Server struct {
 		Scarce      uint64 `json:"scarce"`
 	} `json:"responses"`
 	OverCounts struct {
-		MaxIntegerSize float64 `json:"maxIntegerSize"`
-		RequestCounter uint64  `json:"requestCounter"`
-		InBytes        uint64  `json:"inBytes"`
-		OutBytes       uint64  `json:"outBytes"`
-		OneXx          uint64  `json:"1xx"`
-		TwoXx          uint64  `json:"2xx"`
-		ThreeXx        uint64  `json:"3xx"`
-		FourXx         uint64  `json:"4xx"`
-		FiveXx         uint64  `json:"5xx"`
-		Miss           uint64  `json:"miss"`
-		Bypass         uint64  `json:"bypass"`
-		Expired        uint64  `json:"expired"`
-		Stale          uint64  `json:"stale"`
-		Updating       uint64  `json:"updating"`
-		Revalidated    uint64  `json:"revalidated"`
-		Hit            uint64  `json:"hit"`
-		Scarce         uint64  `json:"scarce"`
+		MaxIntegerSize     float64 `json:"maxIntegerSize"`
+		RequestCounter     uint64  `json:"requestCounter"`
+		InBytes            uint64  `json:"inBytes"`
+		OutBytes           uint64  `json:"outBytes"`
+		OneXx              uint64  `json:"1xx"`
+		TwoXx              uint64  `json:"2xx"`
+		ThreeXx            uint64  `json:"3xx"`
+		FourXx             uint64  `json:"4xx"`
+		FiveXx             uint64  `json:"5xx"`
+		Miss               uint64  `json:"miss"`
+		Bypass             uint64  `json:"bypass"`
+		Expired            uint64  `json:"expired"`
+		Stale              uint64  `json:"stale"`
+		Updating           uint64  `json:"updating"`
+		Revalidated        uint64  `json:"revalidated"`
+		Hit                uint64  `json:"hit"`
+		Scarce             uint64  `json:"scarce"`
+		RequestMsecCounter uint64  `json:"requestMsecCounter"`
 	} `json:"overCounts"`
 }
 
@@ -101,26 +117,36 @@ type Upstream struct {
 		FourXx  uint64 `json:"4xx"`
 		FiveXx  uint64 `json:"5xx"`
 	} `json:"responses"`
-	ResponseMsec uint64 `json:"responseMsec"`
-	RequestMsec  uint64 `json:"requestMsec"`
-	Weight       uint64 `json:"weight"`
-	MaxFails     uint64 `json:"maxFails"`
-	FailTimeout  uint64 `json:"failTimeout"`
-	Backup       bool   `json:"backup"`
-	Down         bool   `json:"down"`
-	OverCounts   struct {
-		MaxIntegerSize float64 `json:"maxIntegerSize"`
-		RequestCounter uint64  `json:"requestCounter"`
-		InBytes        uint64  `json:"inBytes"`
-		OutBytes       uint64  `json:"outBytes"`
-		OneXx          uint64  `json:"1xx"`
-		TwoXx          uint64  `json:"2xx"`
-		ThreeXx        uint64  `json:"3xx"`
-		FourXx         uint64  `json:"4xx"`
-		FiveXx         uint64  `json:"5xx"`
+	ResponseMsec       uint64  `json:"responseMsec"`
+	RequestMsecCounter uint64  `json:"requestMsecCounter"`
+	RequestMsec        uint64  `json:"requestMsec"`
+	RequestBuckets     Buckets `json:"requestBuckets"`
+	Weight             uint64  `json:"weight"`
+	MaxFails           uint64  `json:"maxFails"`
+	FailTimeout        uint64  `json:"failTimeout"`
+	Backup             bool    `json:"backup"`
+	Down               bool    `json:"down"`
+	OverCounts         struct {
+		MaxIntegerSize     float64 `json:"maxIntegerSize"`
+		RequestCounter     uint64  `json:"requestCounter"`
+		InBytes            uint64  `json:"inBytes"`
+		OutBytes           uint64  `json:"outBytes"`
+		OneXx              uint64  `json:"1xx"`
+		TwoXx              uint64  `json:"2xx"`
+		ThreeXx            uint64  `json:"3xx"`
+		FourXx             uint64  `json:"4xx"`
+		FiveXx             uint64  `json:"5xx"`
+		RequestMsecCounter uint64  `json:"requestMsecCounter"`
 	} `json:"overCounts"`
 }
 
+// Buckets is a vts histogram, configured by vhost_traffic_status_histogram_buckets.
+// Each request is counted in the first bucket whose upper bound it fits in.
+type Buckets struct {
+	Msecs    []uint64 `json:"msecs"`
+	Counters []uint64 `json:"counters"`
+}
+
 type Cache struct {
 	MaxSize   uint64 `json:"maxSize"`
 	UsedSize  uint64 `json:"usedSize"`
@@ -151,73 +177,336 @@ type Cache struct {
 	} `json:"overCounts"`
 }
 
+// StreamResponses counts sessions by status, which sts maps to HTTP like
+// classes (e.g. 200 for a normal close, 502 for an unreachable upstream).
+type StreamResponses struct {
+	OneXx   uint64 `json:"1xx"`
+	TwoXx   uint64 `json:"2xx"`
+	ThreeXx uint64 `json:"3xx"`
+	FourXx  uint64 `json:"4xx"`
+	FiveXx  uint64 `json:"5xx"`
+}
+
+type StreamOverCounts struct {
+	MaxIntegerSize     float64 `json:"maxIntegerSize"`
+	ConnectCounter     uint64  `json:"connectCounter"`
+	InBytes            uint64  `json:"inBytes"`
+	OutBytes           uint64  `json:"outBytes"`
+	OneXx              uint64  `json:"1xx"`
+	TwoXx              uint64  `json:"2xx"`
+	ThreeXx            uint64  `json:"3xx"`
+	FourXx             uint64  `json:"4xx"`
+	FiveXx             uint64  `json:"5xx"`
+	SessionMsecCounter uint64  `json:"sessionMsecCounter"`
+}
+
+type StreamServer struct {
+	Port               uint64           `json:"port"`
+	Protocol           string           `json:"protocol"`
+	ConnectCounter     uint64           `json:"connectCounter"`
+	InBytes            uint64           `json:"inBytes"`
+	OutBytes           uint64           `json:"outBytes"`
+	Responses          StreamResponses  `json:"responses"`
+	SessionMsecCounter uint64           `json:"sessionMsecCounter"`
+	SessionMsec        uint64           `json:"sessionMsec"`
+	SessionBuckets     Buckets          `json:"sessionBuckets"`
+	OverCounts         StreamOverCounts `json:"overCounts"`
+}
+
+type StreamUpstream struct {
+	Server             string           `json:"server"`
+	ConnectCounter     uint64           `json:"connectCounter"`
+	InBytes            uint64           `json:"inBytes"`
+	OutBytes           uint64           `json:"outBytes"`
+	Responses          StreamResponses  `json:"responses"`
+	SessionMsecCounter uint64           `json:"sessionMsecCounter"`
+	SessionMsec        uint64           `json:"sessionMsec"`
+	SessionBuckets     Buckets          `json:"sessionBuckets"`
+	USessionMsec       uint64           `json:"uSessionMsec"`
+	UConnectMsec       uint64           `json:"uConnectMsec"`
+	UFirstByteMsec     uint64           `json:"uFirstByteMsec"`
+	Weight             uint64           `json:"weight"`
+	MaxFails           uint64           `json:"maxFails"`
+	FailTimeout        uint64           `json:"failTimeout"`
+	Backup             bool             `json:"backup"`
+	Down               bool             `json:"down"`
+	OverCounts         StreamOverCounts `json:"overCounts"`
+}
+
 type Exporter struct {
 	URI string
+	// SourceType is the format of the status page, vts, stub_status or
+	// prometheus.
+	SourceType string
+	// JSONPCallback is the callback name stripped from JSONP output.
+	JSONPCallback string
+	Timeout       time.Duration
+	// MaxBodySize is the maximum size of the decoded status page in bytes,
+	// unlimited if 0.
+	MaxBodySize int64
+	// Host overrides the request host if set.
+	Host      string
+	Transport http.RoundTripper
+	// ZoneFilters selects the exported zones, keyed by zone kind.
+	ZoneFilters map[string]*zoneFilter
+	// PrometheusNamespace is the namespace of the native vts metrics, and
+	// RenameLabels renames the labels of those without a JSON counterpart.
+	PrometheusNamespace string
+	RenameLabels        map[string]string
+	// CacheTTL is how long a scrape is served to later collections, off if 0.
+	CacheTTL time.Duration
+	// PollInterval is the interval of background polls, off if 0.
+	PollInterval time.Duration
+	// DerivedMetrics adds rates computed from the last two polls.
+	DerivedMetrics bool
+
+	namespace   string
+	constLabels prometheus.Labels
+
+	cacheMu     sync.Mutex
+	cached      *scrapeResult
+	scrapeGroup singleflight.Group
+
+	pollMu   sync.Mutex
+	stopPoll context.CancelFunc
+	lastPoll *scrapeResult
+	snapshot *snapshot
+	previous *snapshot
+
+	infoMetric                                                      *prometheus.Desc
+	upMetric, scrapeDurationMetric                                  *prometheus.Desc
+	scrapeErrors, droppedZones                                      *prometheus.CounterVec
+	cardinalityLimited                                              *prometheus.GaugeVec
+	cacheHits, cacheMisses                                          prometheus.Counter
+	cacheAgeMetric                                                  *prometheus.Desc
+	lastPollMetric, staleMetric                                     *prometheus.Desc
+	serverMetrics, upstreamMetrics, filterMetrics, cacheMetrics     map[string]*prometheus.Desc
+	streamServerMetrics, streamUpstreamMetrics, streamFilterMetrics map[string]*prometheus.Desc
+}
+
+// scrape error stages, used as the stage label of scrape_errors_total
+const (
+	stageFetch  = "fetch"
+	stageRead   = "read"
+	stageDecode = "decode"
+	// the status page exceeded MaxBodySize
+	stageTooLarge = "too_large"
+)
 
-	infoMetric                                                  *prometheus.Desc
-	serverMetrics, upstreamMetrics, filterMetrics, cacheMetrics map[string]*prometheus.Desc
+func newServerMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "server", metricName),
+		docString, labels, constLabels,
+	)
 }
 
-func newServerMetric(metricName string, docString string, labels []string) *prometheus.Desc {
+func newUpstreamMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(
-		prometheus.BuildFQName(*metricsNamespace, "server", metricName),
-		docString, labels, nil,
+		prometheus.BuildFQName(namespace, "upstream", metricName),
+		docString, labels, constLabels,
 	)
 }
 
-func newUpstreamMetric(metricName string, docString string, labels []string) *prometheus.Desc {
+func newFilterMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(
-		prometheus.BuildFQName(*metricsNamespace, "upstream", metricName),
-		docString, labels, nil,
+		prometheus.BuildFQName(namespace, "filter", metricName),
+		docString, labels, constLabels,
 	)
 }
 
-func newFilterMetric(metricName string, docString string, labels []string) *prometheus.Desc {
+func newCacheMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(
-		prometheus.BuildFQName(*metricsNamespace, "filter", metricName),
-		docString, labels, nil,
+		prometheus.BuildFQName(namespace, "cache", metricName),
+		docString, labels, constLabels,
 	)
 }
 
-func newCacheMetric(metricName string, docString string, labels []string) *prometheus.Desc {
+func newStreamServerMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
 	return prometheus.NewDesc(
-		prometheus.BuildFQName(*metricsNamespace, "cache", metricName),
-		docString, labels, nil,
+		prometheus.BuildFQName(namespace, "stream_server", metricName),
+		docString, labels, constLabels,
 	)
 }
 
-func NewExporter(uri string) *Exporter {
+func newStreamUpstreamMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "stream_upstream", metricName),
+		docString, labels, constLabels,
+	)
+}
+
+func newStreamFilterMetric(namespace, metricName, docString string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "stream_filter", metricName),
+		docString, labels, constLabels,
+	)
+}
+
+func NewExporter(namespace, uri string, constLabels prometheus.Labels) *Exporter {
+	scrapeErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "exporter",
+		Name:        "scrape_errors_total",
+		Help:        "Number of errors while scraping nginx vts, by stage.",
+		ConstLabels: constLabels,
+	}, []string{"stage"})
+	for _, stage := range []string{stageFetch, stageRead, stageDecode, stageTooLarge} {
+		scrapeErrors.WithLabelValues(stage)
+	}
+
+	droppedZones := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "exporter",
+		Name:        "dropped_zones_total",
+		Help:        "Number of zones, not series, not exported because of zone filters or limits, by zone kind. An upstream zone counts once whatever its number of backends.",
+		ConstLabels: constLabels,
+	}, []string{"kind"})
+	cardinalityLimited := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "exporter",
+		Name:        "cardinality_limited",
+		Help:        "Whether the zone limit was reached in the last scrape, by zone kind.",
+		ConstLabels: constLabels,
+	}, []string{"kind"})
+	for _, kind := range zoneKinds {
+		droppedZones.WithLabelValues(kind)
+		cardinalityLimited.WithLabelValues(kind)
+	}
+
 	return &Exporter{
-		URI:        uri,
-		infoMetric: newServerMetric("info", "nginx info", []string{"hostName", "nginxVersion"}),
+		URI:                 uri,
+		SourceType:          sourceVts,
+		JSONPCallback:       *nginxJSONPCallback,
+		PrometheusNamespace: *nginxPrometheusNamespace,
+		namespace:           namespace,
+		constLabels:         constLabels,
+		Timeout:             time.Duration(*nginxScrapeTimeout) * time.Second,
+		MaxBodySize:         *nginxMaxBodySize,
+		infoMetric:          newServerMetric(namespace, "info", "nginx info", []string{"hostName", "nginxVersion"}, constLabels),
+		upMetric: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "up"),
+			"Whether the last scrape of nginx vts was successful.", nil, constLabels,
+		),
+		scrapeDurationMetric: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "scrape_duration_seconds"),
+			"Duration of the last scrape of nginx vts.", nil, constLabels,
+		),
+		scrapeErrors: scrapeErrors,
+		droppedZones: droppedZones,
+
+		cardinalityLimited: cardinalityLimited,
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "cache_hits_total",
+			Help:        "Number of collections served from a cached scrape.",
+			ConstLabels: constLabels,
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "cache_misses_total",
+			Help:        "Number of collections that scraped nginx vts because the cached scrape had expired.",
+			ConstLabels: constLabels,
+		}),
+		lastPollMetric: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "last_successful_poll_timestamp_seconds"),
+			"Timestamp of the last successful background poll of nginx vts.", nil, constLabels,
+		),
+		staleMetric: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "snapshot_stale"),
+			"Whether the served metrics are from an older poll because the last poll failed.", nil, constLabels,
+		),
+		cacheAgeMetric: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "exporter", "cache_age_seconds"),
+			"Age of the scrape served by the last collection.", nil, constLabels,
+		),
 		serverMetrics: map[string]*prometheus.Desc{
-			"connections": newServerMetric("connections", "nginx connections", []string{"status"}),
-			"requests":    newServerMetric("requests", "requests counter", []string{"host", "code"}),
-			"bytes":       newServerMetric("bytes", "request/response bytes", []string{"host", "direction"}),
-			"cache":       newServerMetric("cache", "cache counter", []string{"host", "status"}),
-			"requestMsec": newServerMetric("requestMsec", "average of request processing times in milliseconds", []string{"host"}),
-			"sharedzones": newServerMetric("sharedzones", "vts module shared memory metrics", []string{"name", "memstat"}),
+			"connections":       newServerMetric(namespace, "connections", "nginx connections", []string{"status"}, constLabels),
+			"requests":          newServerMetric(namespace, "requests", "requests counter", []string{"host", "code"}, constLabels),
+			"bytes":             newServerMetric(namespace, "bytes", "request/response bytes", []string{"host", "direction"}, constLabels),
+			"cache":             newServerMetric(namespace, "cache", "cache counter", []string{"host", "status"}, constLabels),
+			"requestMsec":       newServerMetric(namespace, "requestMsec", "average of request processing times in milliseconds", []string{"host"}, constLabels),
+			"requestDuration":   newServerMetric(namespace, "request_duration_seconds", "histogram of request processing times in seconds", []string{"host"}, constLabels),
+			"sharedzones":       newServerMetric(namespace, "sharedzones", "vts module shared memory metrics", []string{"name", "memstat"}, constLabels),
+			"requestsPerSecond": newServerMetric(namespace, "requests_per_second", "requests per second between the last two polls", []string{"host"}, constLabels),
+			"errorRatio":        newServerMetric(namespace, "error_ratio", "ratio of 5xx responses between the last two polls", []string{"host"}, constLabels),
+			"requestLatency":    newServerMetric(namespace, "request_latency_seconds", "average request processing time in seconds between the last two polls", []string{"host"}, constLabels),
+			"bytesPerSecond":    newServerMetric(namespace, "bytes_per_second", "request/response bytes per second between the last two polls", []string{"host", "direction"}, constLabels),
 		},
 		upstreamMetrics: map[string]*prometheus.Desc{
-			"requests":     newUpstreamMetric("requests", "requests counter", []string{"upstream", "code", "backend"}),
-			"bytes":        newUpstreamMetric("bytes", "request/response bytes", []string{"upstream", "direction", "backend"}),
-			"responseMsec": newUpstreamMetric("responseMsec", "average of only upstream/backend response processing times in milliseconds", []string{"upstream", "backend"}),
-			"requestMsec":  newUpstreamMetric("requestMsec", "average of request processing times in milliseconds", []string{"upstream", "backend"}),
+			"requests":          newUpstreamMetric(namespace, "requests", "requests counter", []string{"upstream", "code", "backend"}, constLabels),
+			"bytes":             newUpstreamMetric(namespace, "bytes", "request/response bytes", []string{"upstream", "direction", "backend"}, constLabels),
+			"responseMsec":      newUpstreamMetric(namespace, "responseMsec", "average of only upstream/backend response processing times in milliseconds", []string{"upstream", "backend"}, constLabels),
+			"requestMsec":       newUpstreamMetric(namespace, "requestMsec", "average of request processing times in milliseconds", []string{"upstream", "backend"}, constLabels),
+			"requestDuration":   newUpstreamMetric(namespace, "request_duration_seconds", "histogram of request processing times in seconds", []string{"upstream", "backend"}, constLabels),
+			"peerWeight":        newUpstreamMetric(namespace, "peer_weight", "weight of the upstream backend", []string{"upstream", "backend"}, constLabels),
+			"peerMaxFails":      newUpstreamMetric(namespace, "peer_max_fails", "max_fails of the upstream backend", []string{"upstream", "backend"}, constLabels),
+			"peerFailTimeout":   newUpstreamMetric(namespace, "peer_fail_timeout_seconds", "fail_timeout of the upstream backend in seconds", []string{"upstream", "backend"}, constLabels),
+			"peerBackup":        newUpstreamMetric(namespace, "peer_backup", "whether the upstream backend is a backup server", []string{"upstream", "backend"}, constLabels),
+			"peerDown":          newUpstreamMetric(namespace, "peer_down", "whether the upstream backend is marked down", []string{"upstream", "backend"}, constLabels),
+			"requestsPerSecond": newUpstreamMetric(namespace, "requests_per_second", "requests per second between the last two polls", []string{"upstream", "backend"}, constLabels),
+			"errorRatio":        newUpstreamMetric(namespace, "error_ratio", "ratio of 5xx responses between the last two polls", []string{"upstream", "backend"}, constLabels),
+			"requestLatency":    newUpstreamMetric(namespace, "request_latency_seconds", "average request processing time in seconds between the last two polls", []string{"upstream", "backend"}, constLabels),
+			"bytesPerSecond":    newUpstreamMetric(namespace, "bytes_per_second", "request/response bytes per second between the last two polls", []string{"upstream", "backend", "direction"}, constLabels),
 		},
 		filterMetrics: map[string]*prometheus.Desc{
-			"requests":     newFilterMetric("requests", "requests counter", []string{"filter", "filterName", "code"}),
-			"bytes":        newFilterMetric("bytes", "request/response bytes", []string{"filter", "filterName", "direction"}),
-			"responseMsec": newFilterMetric("responseMsec", "average of only upstream/backend response processing times in milliseconds", []string{"filter", "filterName"}),
-			"requestMsec":  newFilterMetric("requestMsec", "average of request processing times in milliseconds", []string{"filter", "filterName"}),
+			"requests":          newFilterMetric(namespace, "requests", "requests counter", []string{"filter", "filterName", "code"}, constLabels),
+			"bytes":             newFilterMetric(namespace, "bytes", "request/response bytes", []string{"filter", "filterName", "direction"}, constLabels),
+			"responseMsec":      newFilterMetric(namespace, "responseMsec", "average of only upstream/backend response processing times in milliseconds", []string{"filter", "filterName"}, constLabels),
+			"requestMsec":       newFilterMetric(namespace, "requestMsec", "average of request processing times in milliseconds", []string{"filter", "filterName"}, constLabels),
+			"requestDuration":   newFilterMetric(namespace, "request_duration_seconds", "histogram of request processing times in seconds", []string{"filter", "filterName"}, constLabels),
+			"requestsPerSecond": newFilterMetric(namespace, "requests_per_second", "requests per second between the last two polls", []string{"filter", "filterName"}, constLabels),
+			"errorRatio":        newFilterMetric(namespace, "error_ratio", "ratio of 5xx responses between the last two polls", []string{"filter", "filterName"}, constLabels),
+			"requestLatency":    newFilterMetric(namespace, "request_latency_seconds", "average request processing time in seconds between the last two polls", []string{"filter", "filterName"}, constLabels),
+			"bytesPerSecond":    newFilterMetric(namespace, "bytes_per_second", "request/response bytes per second between the last two polls", []string{"filter", "filterName", "direction"}, constLabels),
 		},
 		cacheMetrics: map[string]*prometheus.Desc{
-			"requests": newCacheMetric("requests", "cache requests counter", []string{"zone", "status"}),
-			"bytes":    newCacheMetric("bytes", "cache request/response bytes", []string{"zone", "direction"}),
+			"requests": newCacheMetric(namespace, "requests", "cache requests counter", []string{"zone", "status"}, constLabels),
+			"bytes":    newCacheMetric(namespace, "bytes", "cache request/response bytes", []string{"zone", "direction"}, constLabels),
+			"size":     newCacheMetric(namespace, "size_bytes", "cache zone size in bytes", []string{"zone", "type"}, constLabels),
+		},
+		streamServerMetrics: map[string]*prometheus.Desc{
+			"connects":        newStreamServerMetric(namespace, "connects", "stream sessions counter", []string{"listen", "protocol", "code"}, constLabels),
+			"bytes":           newStreamServerMetric(namespace, "bytes", "stream in/out bytes", []string{"listen", "protocol", "direction"}, constLabels),
+			"sessionMsec":     newStreamServerMetric(namespace, "sessionMsec", "average of session durations in milliseconds", []string{"listen", "protocol"}, constLabels),
+			"sessionDuration": newStreamServerMetric(namespace, "session_duration_seconds", "histogram of session durations in seconds", []string{"listen", "protocol"}, constLabels),
+		},
+		streamUpstreamMetrics: map[string]*prometheus.Desc{
+			"connects":              newStreamUpstreamMetric(namespace, "connects", "stream sessions counter", []string{"upstream", "code", "backend"}, constLabels),
+			"bytes":                 newStreamUpstreamMetric(namespace, "bytes", "stream in/out bytes", []string{"upstream", "direction", "backend"}, constLabels),
+			"sessionMsec":           newStreamUpstreamMetric(namespace, "sessionMsec", "average of session durations in milliseconds", []string{"upstream", "backend"}, constLabels),
+			"upstreamSessionMsec":   newStreamUpstreamMetric(namespace, "upstreamSessionMsec", "average of only upstream/backend session durations in milliseconds", []string{"upstream", "backend"}, constLabels),
+			"upstreamConnectMsec":   newStreamUpstreamMetric(namespace, "upstreamConnectMsec", "average of upstream/backend connect times in milliseconds", []string{"upstream", "backend"}, constLabels),
+			"upstreamFirstByteMsec": newStreamUpstreamMetric(namespace, "upstreamFirstByteMsec", "average of upstream/backend first byte times in milliseconds", []string{"upstream", "backend"}, constLabels),
+			"sessionDuration":       newStreamUpstreamMetric(namespace, "session_duration_seconds", "histogram of session durations in seconds", []string{"upstream", "backend"}, constLabels),
+			"peerWeight":            newStreamUpstreamMetric(namespace, "peer_weight", "weight of the upstream backend", []string{"upstream", "backend"}, constLabels),
+			"peerMaxFails":          newStreamUpstreamMetric(namespace, "peer_max_fails", "max_fails of the upstream backend", []string{"upstream", "backend"}, constLabels),
+			"peerFailTimeout":       newStreamUpstreamMetric(namespace, "peer_fail_timeout_seconds", "fail_timeout of the upstream backend in seconds", []string{"upstream", "backend"}, constLabels),
+			"peerBackup":            newStreamUpstreamMetric(namespace, "peer_backup", "whether the upstream backend is a backup server", []string{"upstream", "backend"}, constLabels),
+			"peerDown":              newStreamUpstreamMetric(namespace, "peer_down", "whether the upstream backend is marked down", []string{"upstream", "backend"}, constLabels),
+		},
+		streamFilterMetrics: map[string]*prometheus.Desc{
+			"connects":        newStreamFilterMetric(namespace, "connects", "stream sessions counter", []string{"filter", "filterName", "code"}, constLabels),
+			"bytes":           newStreamFilterMetric(namespace, "bytes", "stream in/out bytes", []string{"filter", "filterName", "direction"}, constLabels),
+			"sessionMsec":     newStreamFilterMetric(namespace, "sessionMsec", "average of session durations in milliseconds", []string{"filter", "filterName"}, constLabels),
+			"sessionDuration": newStreamFilterMetric(namespace, "session_duration_seconds", "histogram of session durations in seconds", []string{"filter", "filterName"}, constLabels),
 		},
 	}
 }
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.infoMetric
+	ch <- e.upMetric
+	ch <- e.scrapeDurationMetric
+	e.scrapeErrors.Describe(ch)
+	e.droppedZones.Describe(ch)
+	e.cardinalityLimited.Describe(ch)
+	e.cacheHits.Describe(ch)
+	e.cacheMisses.Describe(ch)
+	ch <- e.cacheAgeMetric
+	ch <- e.lastPollMetric
+	ch <- e.staleMetric
 	for _, m := range e.serverMetrics {
 		ch <- m
 	}
@@ -230,41 +519,95 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.cacheMetrics {
 		ch <- m
 	}
+	for _, m := range e.streamServerMetrics {
+		ch <- m
+	}
+	for _, m := range e.streamUpstreamMetrics {
+		ch <- m
+	}
+	for _, m := range e.streamFilterMetrics {
+		ch <- m
+	}
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	body, err := fetchHTTP(e.URI, time.Duration(*nginxScrapeTimeout)*time.Second)()
+	var result *scrapeResult
+	if e.polling() {
+		result = e.collectPolled(ch)
+	} else if e.CacheTTL > 0 {
+		result = e.cachedScrape()
+		for _, m := range result.metrics {
+			ch <- m
+		}
+		ch <- prometheus.MustNewConstMetric(e.cacheAgeMetric, prometheus.GaugeValue, time.Since(result.time).Seconds())
+		e.cacheHits.Collect(ch)
+		e.cacheMisses.Collect(ch)
+	} else {
+		result = e.scrapeTo(ch)
+	}
+
+	up := 1.0
+	if result.err != nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(e.upMetric, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(e.scrapeDurationMetric, prometheus.GaugeValue, result.duration.Seconds())
+	e.scrapeErrors.Collect(ch)
+	e.droppedZones.Collect(ch)
+	e.cardinalityLimited.Collect(ch)
+}
+
+// scrape fetches nginx vts and sends its metrics to ch. On failure it
+// returns the stage that failed along with the error.
+func (e *Exporter) scrape(ch chan<- prometheus.Metric) (string, error) {
+	body, err := e.fetch()
 	if err != nil {
-		log.Println("fetchHTTP failed", err)
-		return
+		return stageFetch, err
 	}
 	defer body.Close()
 
-	data, err := io.ReadAll(body)
-	if err != nil {
-		log.Println("ioutil.ReadAll failed", err)
-		return
+	r := &bodyReader{r: body, limit: e.MaxBodySize}
+	if err := e.decode(ch, r); err != nil {
+		return r.stage(err), err
 	}
+	return "", nil
+}
 
-	var nginxVtx NginxVts
-	err = json.Unmarshal(data, &nginxVtx)
-	if err != nil {
-		log.Println("json.Unmarshal failed", err)
-		return
+// decode parses the status page read from r according to SourceType and
+// sends its metrics to ch.
+func (e *Exporter) decode(ch chan<- prometheus.Metric, r io.Reader) error {
+	switch e.SourceType {
+	case sourceStubStatus:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		connections, err := parseStubStatus(data)
+		if err != nil {
+			return err
+		}
+		e.collectConnections(ch, connections)
+		return nil
+	case sourcePrometheus:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return e.collectPrometheus(ch, data, true)
+	default:
+		return e.decodeVts(ch, r)
 	}
+}
 
+// collectVts sends the metrics of a decoded vts status page to ch,
+// counting the zones it drops if countDropped is set.
+func (e *Exporter) collectVts(ch chan<- prometheus.Metric, nginxVtx *NginxVts, countDropped bool) {
 	// info
 	uptime := (nginxVtx.NowMsec - nginxVtx.LoadMsec) / 1000
 	ch <- prometheus.MustNewConstMetric(e.infoMetric, prometheus.GaugeValue, float64(uptime), nginxVtx.HostName, nginxVtx.NginxVersion)
 
 	// connections
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Active), "active")
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Reading), "reading")
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Waiting), "waiting")
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Writing), "writing")
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Accepted), "accepted")
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Handled), "handled")
-	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(nginxVtx.Connections.Requests), "requests")
+	e.collectConnections(ch, nginxVtx.Connections)
 
 	// sharedzones
 	ch <- prometheus.MustNewConstMetric(e.serverMetrics["sharedzones"], prometheus.GaugeValue, float64(nginxVtx.SharedZones.MaxSize), nginxVtx.SharedZones.Name, "maxsize")
@@ -272,110 +615,366 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(e.serverMetrics["sharedzones"], prometheus.GaugeValue, float64(nginxVtx.SharedZones.UsedNode), nginxVtx.SharedZones.Name, "usednode")
 
 	// ServerZones
-	for host, s := range nginxVtx.ServerZones {
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.RequestCounter), host, "total")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.Responses.OneXx), host, "1xx")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.Responses.TwoXx), host, "2xx")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.Responses.ThreeXx), host, "3xx")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.Responses.FourXx), host, "4xx")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, float64(s.Responses.FiveXx), host, "5xx")
+	hosts, otherHosts := e.selectZones(kindServer, sortedKeys(nginxVtx.ServerZones), countDropped)
+	for _, host := range hosts {
+		e.collectServer(ch, host, nginxVtx.ServerZones[host])
+	}
+	if len(otherHosts) > 0 {
+		other := nginxVtx.ServerZones[otherHosts[0]]
+		for _, host := range otherHosts[1:] {
+			other.merge(nginxVtx.ServerZones[host])
+		}
+		e.collectServer(ch, otherZone, other)
+	}
 
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Bypass), host, "bypass")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Expired), host, "expired")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Hit), host, "hit")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Miss), host, "miss")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Revalidated), host, "revalidated")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Scarce), host, "scarce")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Stale), host, "stale")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, float64(s.Responses.Updating), host, "updating")
+	// UpstreamZones
+	names, otherNames := e.selectZones(kindUpstream, sortedKeys(nginxVtx.UpstreamZones), countDropped)
+	for _, name := range names {
+		for _, s := range nginxVtx.UpstreamZones[name] {
+			e.collectUpstream(ch, name, s.Server, s)
+			e.collectUpstreamPeer(ch, name, s)
+		}
+	}
+	var otherUpstreams []Upstream
+	for _, name := range otherNames {
+		otherUpstreams = append(otherUpstreams, nginxVtx.UpstreamZones[name]...)
+	}
+	if len(otherUpstreams) > 0 {
+		other := otherUpstreams[0]
+		for _, s := range otherUpstreams[1:] {
+			other.merge(s)
+		}
+		e.collectUpstream(ch, otherZone, otherZone, other)
+	}
 
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["bytes"], prometheus.CounterValue, float64(s.InBytes), host, "in")
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["bytes"], prometheus.CounterValue, float64(s.OutBytes), host, "out")
+	// FilterZones
+	filterZones := filterZoneNames(nginxVtx.FilterZones)
+	keys, otherKeys := e.selectZones(kindFilter, sortedKeys(filterZones), countDropped)
+	for _, key := range keys {
+		filter, name := filterZones[key][0], filterZones[key][1]
+		e.collectFilter(ch, filter, name, nginxVtx.FilterZones[filter][name])
+	}
+	if len(otherKeys) > 0 {
+		first := filterZones[otherKeys[0]]
+		other := nginxVtx.FilterZones[first[0]][first[1]]
+		for _, key := range otherKeys[1:] {
+			other.merge(nginxVtx.FilterZones[filterZones[key][0]][filterZones[key][1]])
+		}
+		e.collectFilter(ch, otherZone, otherZone, other)
+	}
 
-		ch <- prometheus.MustNewConstMetric(e.serverMetrics["requestMsec"], prometheus.GaugeValue, float64(s.RequestMsec), host)
+	// CacheZones
+	zones, otherZones := e.selectZones(kindCache, sortedKeys(nginxVtx.CacheZones), countDropped)
+	for _, zone := range zones {
+		e.collectCache(ch, zone, nginxVtx.CacheZones[zone])
+	}
+	if len(otherZones) > 0 {
+		other := nginxVtx.CacheZones[otherZones[0]]
+		for _, zone := range otherZones[1:] {
+			other.merge(nginxVtx.CacheZones[zone])
+		}
+		e.collectCache(ch, otherZone, other)
+	}
 
+	// StreamServerZones
+	for _, listen := range sortedKeys(nginxVtx.StreamServerZones) {
+		e.collectStreamServer(ch, listen, nginxVtx.StreamServerZones[listen])
 	}
 
-	// UpstreamZones
-	for name, upstreamList := range nginxVtx.UpstreamZones {
-		for _, s := range upstreamList {
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["responseMsec"], prometheus.GaugeValue, float64(s.ResponseMsec), name, s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requestMsec"], prometheus.GaugeValue, float64(s.RequestMsec), name, s.Server)
-
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(s.RequestCounter), name, "total", s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(s.Responses.OneXx), name, "1xx", s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(s.Responses.TwoXx), name, "2xx", s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(s.Responses.ThreeXx), name, "3xx", s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(s.Responses.FourXx), name, "4xx", s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, float64(s.Responses.FiveXx), name, "5xx", s.Server)
-
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["bytes"], prometheus.CounterValue, float64(s.InBytes), name, "in", s.Server)
-			ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["bytes"], prometheus.CounterValue, float64(s.OutBytes), name, "out", s.Server)
+	// StreamUpstreamZones
+	for _, name := range sortedKeys(nginxVtx.StreamUpstreamZones) {
+		for _, s := range nginxVtx.StreamUpstreamZones[name] {
+			e.collectStreamUpstream(ch, name, s)
 		}
 	}
 
-	// FilterZones
-	for filter, values := range nginxVtx.FilterZones {
-		for name, stat := range values {
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["responseMsec"], prometheus.GaugeValue, float64(stat.ResponseMsec), filter, name)
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requestMsec"], prometheus.GaugeValue, float64(stat.RequestMsec), filter, name)
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, float64(stat.RequestCounter), filter, name, "total")
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, float64(stat.Responses.OneXx), filter, name, "1xx")
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, float64(stat.Responses.TwoXx), filter, name, "2xx")
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, float64(stat.Responses.ThreeXx), filter, name, "3xx")
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, float64(stat.Responses.FourXx), filter, name, "4xx")
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, float64(stat.Responses.FiveXx), filter, name, "5xx")
-
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["bytes"], prometheus.CounterValue, float64(stat.InBytes), filter, name, "in")
-			ch <- prometheus.MustNewConstMetric(e.filterMetrics["bytes"], prometheus.CounterValue, float64(stat.OutBytes), filter, name, "out")
+	// StreamFilterZones
+	streamFilterZones := filterZoneNames(nginxVtx.StreamFilterZones)
+	keys, otherKeys = e.selectZones(kindStreamFilter, sortedKeys(streamFilterZones), countDropped)
+	for _, key := range keys {
+		filter, name := streamFilterZones[key][0], streamFilterZones[key][1]
+		e.collectStreamFilter(ch, filter, name, nginxVtx.StreamFilterZones[filter][name])
+	}
+	if len(otherKeys) > 0 {
+		first := streamFilterZones[otherKeys[0]]
+		other := nginxVtx.StreamFilterZones[first[0]][first[1]]
+		for _, key := range otherKeys[1:] {
+			other.merge(nginxVtx.StreamFilterZones[streamFilterZones[key][0]][streamFilterZones[key][1]])
 		}
+		e.collectStreamFilter(ch, otherZone, otherZone, other)
 	}
+}
 
-	// CacheZones
-	for zone, s := range nginxVtx.CacheZones {
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Bypass), zone, "bypass")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Expired), zone, "expired")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Hit), zone, "hit")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Miss), zone, "miss")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Revalidated), zone, "revalidated")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Scarce), zone, "scarce")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Stale), zone, "stale")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, float64(s.Responses.Updating), zone, "updating")
+func (e *Exporter) collectConnections(ch chan<- prometheus.Metric, c Connections) {
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Active), "active")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Reading), "reading")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Waiting), "waiting")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Writing), "writing")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Accepted), "accepted")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Handled), "handled")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["connections"], prometheus.GaugeValue, float64(c.Requests), "requests")
+}
+
+func (e *Exporter) collectServer(ch chan<- prometheus.Metric, host string, s Server) {
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize), host, "total")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.OneXx, s.OverCounts.OneXx, s.OverCounts.MaxIntegerSize), host, "1xx")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.TwoXx, s.OverCounts.TwoXx, s.OverCounts.MaxIntegerSize), host, "2xx")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.ThreeXx, s.OverCounts.ThreeXx, s.OverCounts.MaxIntegerSize), host, "3xx")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.FourXx, s.OverCounts.FourXx, s.OverCounts.MaxIntegerSize), host, "4xx")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.FiveXx, s.OverCounts.FiveXx, s.OverCounts.MaxIntegerSize), host, "5xx")
+
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Bypass, s.OverCounts.Bypass, s.OverCounts.MaxIntegerSize), host, "bypass")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Expired, s.OverCounts.Expired, s.OverCounts.MaxIntegerSize), host, "expired")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Hit, s.OverCounts.Hit, s.OverCounts.MaxIntegerSize), host, "hit")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Miss, s.OverCounts.Miss, s.OverCounts.MaxIntegerSize), host, "miss")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Revalidated, s.OverCounts.Revalidated, s.OverCounts.MaxIntegerSize), host, "revalidated")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Scarce, s.OverCounts.Scarce, s.OverCounts.MaxIntegerSize), host, "scarce")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Stale, s.OverCounts.Stale, s.OverCounts.MaxIntegerSize), host, "stale")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["cache"], prometheus.CounterValue, counterValue(s.Responses.Updating, s.OverCounts.Updating, s.OverCounts.MaxIntegerSize), host, "updating")
 
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["bytes"], prometheus.CounterValue, float64(s.InBytes), zone, "in")
-		ch <- prometheus.MustNewConstMetric(e.cacheMetrics["bytes"], prometheus.CounterValue, float64(s.OutBytes), zone, "out")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, s.OverCounts.InBytes, s.OverCounts.MaxIntegerSize), host, "in")
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, s.OverCounts.OutBytes, s.OverCounts.MaxIntegerSize), host, "out")
+
+	ch <- prometheus.MustNewConstMetric(e.serverMetrics["requestMsec"], prometheus.GaugeValue, float64(s.RequestMsec), host)
+
+	if count, ok := histogramCount(counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize)); ok && len(s.RequestBuckets.Msecs) > 0 {
+		sum := counterValue(s.RequestMsecCounter, s.OverCounts.RequestMsecCounter, s.OverCounts.MaxIntegerSize) / 1000
+		ch <- prometheus.MustNewConstHistogram(e.serverMetrics["requestDuration"], count, sum, histogramBuckets(s.RequestBuckets), host)
 	}
 }
 
-func fetchHTTP(uri string, timeout time.Duration) func() (io.ReadCloser, error) {
-	http.DefaultClient.Timeout = timeout
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: *insecure}
+func (e *Exporter) collectUpstream(ch chan<- prometheus.Metric, name, backend string, s Upstream) {
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["responseMsec"], prometheus.GaugeValue, float64(s.ResponseMsec), name, backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requestMsec"], prometheus.GaugeValue, float64(s.RequestMsec), name, backend)
 
-	return func() (io.ReadCloser, error) {
-		resp, err := http.DefaultClient.Get(uri)
-		if err != nil {
-			return nil, err
-		}
-		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			resp.Body.Close()
-			return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	if count, ok := histogramCount(counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize)); ok && len(s.RequestBuckets.Msecs) > 0 {
+		sum := counterValue(s.RequestMsecCounter, s.OverCounts.RequestMsecCounter, s.OverCounts.MaxIntegerSize) / 1000
+		ch <- prometheus.MustNewConstHistogram(e.upstreamMetrics["requestDuration"], count, sum, histogramBuckets(s.RequestBuckets), name, backend)
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize), name, "total", backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.OneXx, s.OverCounts.OneXx, s.OverCounts.MaxIntegerSize), name, "1xx", backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.TwoXx, s.OverCounts.TwoXx, s.OverCounts.MaxIntegerSize), name, "2xx", backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.ThreeXx, s.OverCounts.ThreeXx, s.OverCounts.MaxIntegerSize), name, "3xx", backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.FourXx, s.OverCounts.FourXx, s.OverCounts.MaxIntegerSize), name, "4xx", backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.FiveXx, s.OverCounts.FiveXx, s.OverCounts.MaxIntegerSize), name, "5xx", backend)
+
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, s.OverCounts.InBytes, s.OverCounts.MaxIntegerSize), name, "in", backend)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, s.OverCounts.OutBytes, s.OverCounts.MaxIntegerSize), name, "out", backend)
+}
+
+// collectUpstreamPeer exports the configuration and state of an upstream backend.
+func (e *Exporter) collectUpstreamPeer(ch chan<- prometheus.Metric, name string, s Upstream) {
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peerWeight"], prometheus.GaugeValue, float64(s.Weight), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peerMaxFails"], prometheus.GaugeValue, float64(s.MaxFails), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peerFailTimeout"], prometheus.GaugeValue, float64(s.FailTimeout), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peerBackup"], prometheus.GaugeValue, boolValue(s.Backup), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.upstreamMetrics["peerDown"], prometheus.GaugeValue, boolValue(s.Down), name, s.Server)
+}
+
+func (e *Exporter) collectFilter(ch chan<- prometheus.Metric, filter, name string, s Upstream) {
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["responseMsec"], prometheus.GaugeValue, float64(s.ResponseMsec), filter, name)
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requestMsec"], prometheus.GaugeValue, float64(s.RequestMsec), filter, name)
+
+	if count, ok := histogramCount(counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize)); ok && len(s.RequestBuckets.Msecs) > 0 {
+		sum := counterValue(s.RequestMsecCounter, s.OverCounts.RequestMsecCounter, s.OverCounts.MaxIntegerSize) / 1000
+		ch <- prometheus.MustNewConstHistogram(e.filterMetrics["requestDuration"], count, sum, histogramBuckets(s.RequestBuckets), filter, name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize), filter, name, "total")
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.OneXx, s.OverCounts.OneXx, s.OverCounts.MaxIntegerSize), filter, name, "1xx")
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.TwoXx, s.OverCounts.TwoXx, s.OverCounts.MaxIntegerSize), filter, name, "2xx")
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.ThreeXx, s.OverCounts.ThreeXx, s.OverCounts.MaxIntegerSize), filter, name, "3xx")
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.FourXx, s.OverCounts.FourXx, s.OverCounts.MaxIntegerSize), filter, name, "4xx")
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.FiveXx, s.OverCounts.FiveXx, s.OverCounts.MaxIntegerSize), filter, name, "5xx")
+
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, s.OverCounts.InBytes, s.OverCounts.MaxIntegerSize), filter, name, "in")
+	ch <- prometheus.MustNewConstMetric(e.filterMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, s.OverCounts.OutBytes, s.OverCounts.MaxIntegerSize), filter, name, "out")
+}
+
+func (e *Exporter) collectCache(ch chan<- prometheus.Metric, zone string, s Cache) {
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Bypass, s.OverCounts.Bypass, s.OverCounts.MaxIntegerSize), zone, "bypass")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Expired, s.OverCounts.Expired, s.OverCounts.MaxIntegerSize), zone, "expired")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Hit, s.OverCounts.Hit, s.OverCounts.MaxIntegerSize), zone, "hit")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Miss, s.OverCounts.Miss, s.OverCounts.MaxIntegerSize), zone, "miss")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Revalidated, s.OverCounts.Revalidated, s.OverCounts.MaxIntegerSize), zone, "revalidated")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Scarce, s.OverCounts.Scarce, s.OverCounts.MaxIntegerSize), zone, "scarce")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Stale, s.OverCounts.Stale, s.OverCounts.MaxIntegerSize), zone, "stale")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["requests"], prometheus.CounterValue, counterValue(s.Responses.Updating, s.OverCounts.Updating, s.OverCounts.MaxIntegerSize), zone, "updating")
+
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, s.OverCounts.InBytes, s.OverCounts.MaxIntegerSize), zone, "in")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, s.OverCounts.OutBytes, s.OverCounts.MaxIntegerSize), zone, "out")
+
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["size"], prometheus.GaugeValue, float64(s.MaxSize), zone, "max")
+	ch <- prometheus.MustNewConstMetric(e.cacheMetrics["size"], prometheus.GaugeValue, float64(s.UsedSize), zone, "used")
+}
+
+func (e *Exporter) collectStreamServer(ch chan<- prometheus.Metric, listen string, s StreamServer) {
+	o := s.OverCounts
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connects"], prometheus.CounterValue, counterValue(s.ConnectCounter, o.ConnectCounter, o.MaxIntegerSize), listen, s.Protocol, "total")
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.OneXx, o.OneXx, o.MaxIntegerSize), listen, s.Protocol, "1xx")
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.TwoXx, o.TwoXx, o.MaxIntegerSize), listen, s.Protocol, "2xx")
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.ThreeXx, o.ThreeXx, o.MaxIntegerSize), listen, s.Protocol, "3xx")
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.FourXx, o.FourXx, o.MaxIntegerSize), listen, s.Protocol, "4xx")
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.FiveXx, o.FiveXx, o.MaxIntegerSize), listen, s.Protocol, "5xx")
+
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, o.InBytes, o.MaxIntegerSize), listen, s.Protocol, "in")
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, o.OutBytes, o.MaxIntegerSize), listen, s.Protocol, "out")
+
+	ch <- prometheus.MustNewConstMetric(e.streamServerMetrics["sessionMsec"], prometheus.GaugeValue, float64(s.SessionMsec), listen, s.Protocol)
+
+	if count, ok := histogramCount(counterValue(s.ConnectCounter, o.ConnectCounter, o.MaxIntegerSize)); ok && len(s.SessionBuckets.Msecs) > 0 {
+		sum := counterValue(s.SessionMsecCounter, o.SessionMsecCounter, o.MaxIntegerSize) / 1000
+		ch <- prometheus.MustNewConstHistogram(e.streamServerMetrics["sessionDuration"], count, sum, histogramBuckets(s.SessionBuckets), listen, s.Protocol)
+	}
+}
+
+func (e *Exporter) collectStreamUpstream(ch chan<- prometheus.Metric, name string, s StreamUpstream) {
+	o := s.OverCounts
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connects"], prometheus.CounterValue, counterValue(s.ConnectCounter, o.ConnectCounter, o.MaxIntegerSize), name, "total", s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.OneXx, o.OneXx, o.MaxIntegerSize), name, "1xx", s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.TwoXx, o.TwoXx, o.MaxIntegerSize), name, "2xx", s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.ThreeXx, o.ThreeXx, o.MaxIntegerSize), name, "3xx", s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.FourXx, o.FourXx, o.MaxIntegerSize), name, "4xx", s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.FiveXx, o.FiveXx, o.MaxIntegerSize), name, "5xx", s.Server)
+
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, o.InBytes, o.MaxIntegerSize), name, "in", s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, o.OutBytes, o.MaxIntegerSize), name, "out", s.Server)
+
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["sessionMsec"], prometheus.GaugeValue, float64(s.SessionMsec), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["upstreamSessionMsec"], prometheus.GaugeValue, float64(s.USessionMsec), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["upstreamConnectMsec"], prometheus.GaugeValue, float64(s.UConnectMsec), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["upstreamFirstByteMsec"], prometheus.GaugeValue, float64(s.UFirstByteMsec), name, s.Server)
+
+	if count, ok := histogramCount(counterValue(s.ConnectCounter, o.ConnectCounter, o.MaxIntegerSize)); ok && len(s.SessionBuckets.Msecs) > 0 {
+		sum := counterValue(s.SessionMsecCounter, o.SessionMsecCounter, o.MaxIntegerSize) / 1000
+		ch <- prometheus.MustNewConstHistogram(e.streamUpstreamMetrics["sessionDuration"], count, sum, histogramBuckets(s.SessionBuckets), name, s.Server)
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["peerWeight"], prometheus.GaugeValue, float64(s.Weight), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["peerMaxFails"], prometheus.GaugeValue, float64(s.MaxFails), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["peerFailTimeout"], prometheus.GaugeValue, float64(s.FailTimeout), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["peerBackup"], prometheus.GaugeValue, boolValue(s.Backup), name, s.Server)
+	ch <- prometheus.MustNewConstMetric(e.streamUpstreamMetrics["peerDown"], prometheus.GaugeValue, boolValue(s.Down), name, s.Server)
+}
+
+func (e *Exporter) collectStreamFilter(ch chan<- prometheus.Metric, filter, name string, s StreamUpstream) {
+	o := s.OverCounts
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["connects"], prometheus.CounterValue, counterValue(s.ConnectCounter, o.ConnectCounter, o.MaxIntegerSize), filter, name, "total")
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.OneXx, o.OneXx, o.MaxIntegerSize), filter, name, "1xx")
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.TwoXx, o.TwoXx, o.MaxIntegerSize), filter, name, "2xx")
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.ThreeXx, o.ThreeXx, o.MaxIntegerSize), filter, name, "3xx")
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.FourXx, o.FourXx, o.MaxIntegerSize), filter, name, "4xx")
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["connects"], prometheus.CounterValue, counterValue(s.Responses.FiveXx, o.FiveXx, o.MaxIntegerSize), filter, name, "5xx")
+
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["bytes"], prometheus.CounterValue, counterValue(s.InBytes, o.InBytes, o.MaxIntegerSize), filter, name, "in")
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["bytes"], prometheus.CounterValue, counterValue(s.OutBytes, o.OutBytes, o.MaxIntegerSize), filter, name, "out")
+
+	ch <- prometheus.MustNewConstMetric(e.streamFilterMetrics["sessionMsec"], prometheus.GaugeValue, float64(s.SessionMsec), filter, name)
+
+	if count, ok := histogramCount(counterValue(s.ConnectCounter, o.ConnectCounter, o.MaxIntegerSize)); ok && len(s.SessionBuckets.Msecs) > 0 {
+		sum := counterValue(s.SessionMsecCounter, o.SessionMsecCounter, o.MaxIntegerSize) / 1000
+		ch <- prometheus.MustNewConstHistogram(e.streamFilterMetrics["sessionDuration"], count, sum, histogramBuckets(s.SessionBuckets), filter, name)
+	}
+}
+
+// counterValue corrects a vts counter for integer overflow, using the
+// number of times it has wrapped as reported in overCounts.
+func counterValue(value, overCount uint64, maxIntegerSize float64) float64 {
+	return float64(overCount)*maxIntegerSize + float64(value)
+}
+
+// histogramCount converts a counter corrected by counterValue to the count
+// of a histogram. A counter that has gone past 2^64 does not fit, so the
+// histogram of its zone is skipped rather than exported with a wrong count.
+func histogramCount(count float64) (uint64, bool) {
+	// float64(math.MaxUint64) rounds up to 2^64
+	if count >= math.MaxUint64 {
+		return 0, false
+	}
+	return uint64(count), true
+}
+
+// histogramBuckets converts vts buckets to the cumulative buckets of a
+// Prometheus histogram, keyed by upper bound in seconds.
+func histogramBuckets(b Buckets) map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(b.Msecs))
+	var cumulative uint64
+	for i, msec := range b.Msecs {
+		if i < len(b.Counters) {
+			cumulative += b.Counters[i]
 		}
-		return resp.Body, nil
+		buckets[float64(msec)/1000] = cumulative
 	}
+	return buckets
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 var (
-	showVersion        = flag.Bool("version", false, "Print version information.")
-	listenAddress      = flag.String("telemetry.address", ":9913", "Address on which to expose metrics.")
-	metricsEndpoint    = flag.String("telemetry.endpoint", "/metrics", "Path under which to expose metrics.")
-	metricsNamespace   = flag.String("metrics.namespace", "nginx", "Prometheus metrics namespace.")
-	nginxScrapeURI     = flag.String("nginx.scrape_uri", "http://localhost/status", "URI to nginx stub status page")
-	insecure           = flag.Bool("insecure", true, "Ignore server certificate if using https")
-	nginxScrapeTimeout = flag.Int("nginx.scrape_timeout", 2, "The number of seconds to wait for an HTTP response from the nginx.scrape_uri")
-	goMetrics          = flag.Bool("go.metrics", false, "Export process and go metrics.")
+	showVersion              = flag.Bool("version", false, "Print version information.")
+	listenAddress            = flag.String("telemetry.address", ":9913", "Address on which to expose metrics.")
+	metricsEndpoint          = flag.String("telemetry.endpoint", "/metrics", "Path under which to expose metrics.")
+	webConfigFile            = flag.String("web.config.file", "", "Path to an exporter-toolkit web configuration file enabling TLS or basic authentication.")
+	metricsNamespace         = flag.String("metrics.namespace", "nginx", "Prometheus metrics namespace.")
+	nginxScrapeURI           = flag.String("nginx.scrape_uri", "http://localhost/status", "URI to nginx stub status page, unix:///path/to/socket:/status to scrape over a Unix domain socket, file:///path/to/status.json or - to read from stdin")
+	nginxSourceType          = flag.String("nginx.source_type", "vts", "Format of the nginx status page: vts, stub_status for the ngx_http_stub_status_module, or prometheus for /status/format/prometheus.")
+	nginxPrometheusNamespace = flag.String("nginx.prometheus_namespace", "nginx_vts", "Namespace of the metrics of /status/format/prometheus, renamed to metrics.namespace.")
+	nginxJSONPCallback       = flag.String("nginx.jsonp_callback", "ngx_http_vhost_traffic_status_jsonp", "Callback name to strip when the status page is in JSONP format, see vhost_traffic_status_jsonp.")
+	nginxMaxBodySize         = flag.Int64("nginx.max_body_size", 64<<20, "Maximum size of the decoded nginx status page in bytes, unlimited if 0.")
+	nginxCacheTTL            = flag.Duration("nginx.cache_ttl", 0, "How long a scrape of nginx.scrape_uri is served to later collections, e.g. 5s. Disabled if 0.")
+	nginxPollInterval        = flag.Duration("nginx.poll_interval", 0, "Poll nginx.scrape_uri in the background at this interval and serve the last good poll, e.g. 5s. Disabled if 0.")
+	derivedMetrics           = flag.Bool("nginx.derived_metrics", false, "Export request rates, 5xx ratios and throughput computed from the last two polls, with nginx.poll_interval and the vts source type.")
+	nginxUsername            = flag.String("nginx.basic_auth.username", "", "Username for basic authentication to nginx.scrape_uri.")
+	nginxPasswordFile        = flag.String("nginx.basic_auth.password_file", "", "File holding the password for basic authentication to nginx.scrape_uri, read on every scrape.")
+	nginxBearerTokenFile     = flag.String("nginx.bearer_token_file", "", "File holding a bearer token sent to nginx.scrape_uri, read on every scrape.")
+	nginxHeaders             = headerFlags{}
+	insecure                 = &optionalBool{}
+	nginxTLSCAFile           = flag.String("nginx.tls.ca_file", "", "CA certificate file to verify nginx.scrape_uri with.")
+	nginxTLSCertFile         = flag.String("nginx.tls.cert_file", "", "Client certificate file for TLS authentication to nginx.scrape_uri.")
+	nginxTLSKeyFile          = flag.String("nginx.tls.key_file", "", "Client key file for TLS authentication to nginx.scrape_uri.")
+	nginxTLSServerName       = flag.String("nginx.tls.server_name", "", "Server name to verify the certificate of nginx.scrape_uri against.")
+	nginxTLSMinVersion       = flag.String("nginx.tls.min_version", "", "Minimum TLS version to scrape nginx.scrape_uri with, e.g. TLS12.")
+	configFile               = flag.String("config.file", "", "Path to a YAML file listing the nginx targets to scrape, overrides nginx.scrape_uri.")
+	nginxScrapeTimeout       = flag.Int("nginx.scrape_timeout", 2, "The number of seconds to wait for an HTTP response from the nginx.scrape_uri")
+	goMetrics                = flag.Bool("go.metrics", false, "Export process and go metrics.")
+	oneshot                  = flag.Bool("oneshot", false, "Print the metrics of a single scrape to stdout and exit.")
+	serverZonesInclude       = flag.String("zones.server.include", "", "Regex of server zones to export, all if empty.")
+	serverZonesExclude       = flag.String("zones.server.exclude", "", "Regex of server zones not to export.")
+	upstreamZonesInclude     = flag.String("zones.upstream.include", "", "Regex of upstream zones to export, all if empty.")
+	upstreamZonesExclude     = flag.String("zones.upstream.exclude", "", "Regex of upstream zones not to export.")
+	filterZonesInclude       = flag.String("zones.filter.include", "", "Regex of filter zones to export, matched as <filter>::<filterName>, all if empty.")
+	filterZonesExclude       = flag.String("zones.filter.exclude", "", "Regex of filter zones not to export, matched as <filter>::<filterName>.")
+	cacheZonesInclude        = flag.String("zones.cache.include", "", "Regex of cache zones to export, all if empty.")
+	cacheZonesExclude        = flag.String("zones.cache.exclude", "", "Regex of cache zones not to export.")
+	serverZonesLimit         = flag.Int("zones.server.limit", 0, "Maximum number of server zones to export, unlimited if 0.")
+	upstreamZonesLimit       = flag.Int("zones.upstream.limit", 0, "Maximum number of upstream zones to export, unlimited if 0.")
+	filterZonesLimit         = flag.Int("zones.filter.limit", 0, "Maximum number of filter zones to export, unlimited if 0.")
+	cacheZonesLimit          = flag.Int("zones.cache.limit", 0, "Maximum number of cache zones to export, unlimited if 0.")
+	streamFilterZonesInclude = flag.String("zones.stream_filter.include", "", "Regex of stream filter zones to export, matched as <filter>::<filterName>, all if empty.")
+	streamFilterZonesExclude = flag.String("zones.stream_filter.exclude", "", "Regex of stream filter zones not to export, matched as <filter>::<filterName>.")
+	streamFilterZonesLimit   = flag.Int("zones.stream_filter.limit", 0, "Maximum number of stream filter zones to export, unlimited if 0.")
+	zonesLimitAction         = flag.String("zones.limit_action", "drop", "What to do with zones beyond the limit: drop them, or fold them into an __other__ zone.")
+	probeTimeoutOffset       = flag.Float64("probe.timeout_offset", 0.5, "Offset to subtract from the Prometheus scrape timeout when probing a target, in seconds.")
+	pushURL                  = flag.String("push.url", "", "URL of a Pushgateway to push the metrics to every push.interval, e.g. http://pushgateway:9091. Disabled if empty.")
+	pushInterval             = flag.Duration("push.interval", 15*time.Second, "Interval between pushes to push.url.")
+	pushJob                  = flag.String("push.job", "nginx_vts_exporter", "Job label of the pushed metrics.")
+	pushGrouping             = labelFlags{}
+	pushUsername             = flag.String("push.basic_auth.username", "", "Username for basic authentication to push.url.")
+	pushPasswordFile         = flag.String("push.basic_auth.password_file", "", "File holding the password for basic authentication to push.url, read on every push.")
+	pushRetries              = flag.Int("push.retries", 3, "Number of times a failed push is retried before the next push.interval.")
+	pushTimeout              = flag.Duration("push.timeout", 10*time.Second, "Timeout of a single push to push.url.")
 )
 
 func init() {
+	flag.Var(insecure, "insecure", "Ignore server certificate if using https. Defaults to true, or false when a -nginx.tls.* flag is set.")
+	flag.Var(nginxHeaders, "nginx.header", "Header sent to nginx.scrape_uri as \"Name: value\", including Host. May be repeated.")
+	flag.Var(pushGrouping, "push.grouping", "Grouping label of the pushed metrics as \"name=value\", besides job. May be repeated.")
 	prometheus.MustRegister(cversion.NewCollector("nginx_vts_exporter"))
 }
 
@@ -394,8 +993,49 @@ func (*app) run() {
 	log.Printf("Starting nginx_vts_exporter %s", version.Info())
 	log.Printf("Build context %s", version.BuildContext())
 
-	exporter := NewExporter(*nginxScrapeURI)
-	prometheus.MustRegister(exporter)
+	collector := &reloadableCollector{}
+	if err := collector.reload(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *oneshot {
+		up, err := writeMetrics(os.Stdout, collector, collector.Namespace())
+		if err != nil {
+			log.Fatal(err)
+		}
+		// let batch jobs detect a failed scrape
+		if !up {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	prometheus.MustRegister(collector)
+	collector.startPolling()
+
+	if *pushURL != "" {
+		pusher, err := newPusher(collector)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go runPusher(context.Background(), pusher)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := collector.reload()
+			switch {
+			case errors.Is(err, errReloadSkipped):
+				log.Println("Not reloading configuration:", err)
+			case err != nil:
+				log.Println("reloading configuration failed", err)
+			default:
+				log.Println("Reloaded configuration")
+			}
+		}
+	}()
 
 	if !(*goMetrics) {
 		prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{
@@ -407,21 +1047,66 @@ func (*app) run() {
 	}
 
 	http.Handle(*metricsEndpoint, promhttp.Handler())
+	http.Handle("/probe", probeHandler(collector.NewExporter))
+	http.HandleFunc("/-/reload", collector.reloadHandler)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(`<html>
 			<head><title>Nginx Exporter</title></head>
 			<body>
 			<h1>Nginx Exporter</h1>
 			<p><a href="` + *metricsEndpoint + `">Metrics</a></p>
+			<p><a href="/probe?target=http://localhost/status/format/json">Probe http://localhost/status/format/json</a></p>
 			</body>
 			</html>`))
 	})
 
 	log.Printf("Starting Server at : %s", *listenAddress)
 	log.Printf("Metrics endpoint: %s", *metricsEndpoint)
-	log.Printf("Metrics namespace: %s", *metricsNamespace)
-	log.Printf("Scraping information from : %s", *nginxScrapeURI)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	log.Printf("Metrics namespace: %s", collector.Namespace())
+	if *configFile != "" {
+		log.Printf("Scraping targets from config file : %s", *configFile)
+	} else {
+		log.Printf("Scraping information from : %s", *nginxScrapeURI)
+	}
+	if *webConfigFile != "" {
+		log.Printf("Web config file : %s", *webConfigFile)
+	}
+	if *pushURL != "" {
+		log.Printf("Pushing metrics every %s to : %s", *pushInterval, *pushURL)
+	}
+
+	listenAddresses := []string{*listenAddress}
+	systemdSocket := false
+	log.Fatal(web.ListenAndServe(&http.Server{}, &web.FlagConfig{
+		WebListenAddresses: &listenAddresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      webConfigFile,
+	}, slog.Default()))
+}
+
+// writeMetrics scrapes c once and writes the metrics to w in the text
+// exposition format. up reports whether the {namespace}_up metrics of all
+// targets are 1.
+func writeMetrics(w io.Writer, c prometheus.Collector, namespace string) (up bool, err error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		return false, err
+	}
+	up = true
+	for _, mf := range mfs {
+		if mf.GetName() == prometheus.BuildFQName(namespace, "", "up") {
+			for _, m := range mf.GetMetric() {
+				up = up && m.GetGauge().GetValue() == 1
+			}
+		}
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return false, err
+		}
+	}
+	return up, nil
 }
 
 func main() {
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectRequestDurationOverflow(t *testing.T) {
+	tests := []struct {
+		name       string
+		overCount  int
+		want       []string
+		wantAbsent []string
+	}{
+		{
+			name:      "not wrapped",
+			overCount: 0,
+			want: []string{
+				`nginx_server_requests{code="total",host="a"} 10`,
+				`nginx_server_request_duration_seconds_count{host="a"} 10`,
+				`nginx_server_request_duration_seconds_bucket{host="a",le="0.1"} 10`,
+			},
+		},
+		{
+			name:      "wrapped",
+			overCount: 1,
+			want: []string{
+				`nginx_server_requests{code="total",host="a"} 1.8446744073709552e+19`,
+			},
+			wantAbsent: []string{
+				`nginx_server_request_duration_seconds`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"serverZones": {"a": {
+				"requestCounter": 10, "requestMsecCounter": 100,
+				"requestBuckets": {"msecs": [100], "counters": [10]},
+				"overCounts": {"maxIntegerSize": 18446744073709551615, "requestCounter": %d}
+			}}}`, tt.overCount)
+			lines := scrapeLines(t, fixtureExporter(t, body))
+			if !hasSample(lines, "nginx_up 1") {
+				t.Fatalf("scrape failed:\n%s", strings.Join(lines, "\n"))
+			}
+			for _, want := range tt.want {
+				if !hasSample(lines, want) {
+					t.Errorf("missing %s", want)
+				}
+			}
+			for _, absent := range tt.wantAbsent {
+				if hasSample(lines, absent) {
+					t.Errorf("unexpected %s", absent)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectZones(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		zones  ZonesConfig
+		want   []string
+	}{
+		{
+			name: "upstream peers",
+			status: `{"upstreamZones": {"app": [
+				{"server": "10.0.0.1:80", "weight": 5, "maxFails": 2, "failTimeout": 30, "backup": false, "down": true},
+				{"server": "10.0.0.2:80", "weight": 1, "maxFails": 0, "failTimeout": 10, "backup": true, "down": false}
+			]}}`,
+			want: []string{
+				`nginx_upstream_peer_weight{backend="10.0.0.1:80",upstream="app"} 5`,
+				`nginx_upstream_peer_max_fails{backend="10.0.0.1:80",upstream="app"} 2`,
+				`nginx_upstream_peer_fail_timeout_seconds{backend="10.0.0.1:80",upstream="app"} 30`,
+				`nginx_upstream_peer_backup{backend="10.0.0.1:80",upstream="app"} 0`,
+				`nginx_upstream_peer_down{backend="10.0.0.1:80",upstream="app"} 1`,
+				`nginx_upstream_peer_weight{backend="10.0.0.2:80",upstream="app"} 1`,
+				`nginx_upstream_peer_max_fails{backend="10.0.0.2:80",upstream="app"} 0`,
+				`nginx_upstream_peer_fail_timeout_seconds{backend="10.0.0.2:80",upstream="app"} 10`,
+				`nginx_upstream_peer_backup{backend="10.0.0.2:80",upstream="app"} 1`,
+				`nginx_upstream_peer_down{backend="10.0.0.2:80",upstream="app"} 0`,
+			},
+		},
+		{
+			name: "cache size",
+			status: `{"cacheZones": {
+				"a": {"maxSize": 1048576, "usedSize": 4096},
+				"b": {"maxSize": 2097152, "usedSize": 8192},
+				"c": {"maxSize": 4194304, "usedSize": 16384}
+			}}`,
+			want: []string{
+				`nginx_cache_size_bytes{type="max",zone="a"} 1.048576e+06`,
+				`nginx_cache_size_bytes{type="used",zone="a"} 4096`,
+				`nginx_cache_size_bytes{type="max",zone="c"} 4.194304e+06`,
+				`nginx_cache_size_bytes{type="used",zone="c"} 16384`,
+			},
+		},
+		{
+			name: "cache size folded",
+			status: `{"cacheZones": {
+				"a": {"maxSize": 1048576, "usedSize": 4096},
+				"b": {"maxSize": 2097152, "usedSize": 8192},
+				"c": {"maxSize": 4194304, "usedSize": 16384}
+			}}`,
+			zones: ZonesConfig{LimitAction: limitFold, Cache: ZoneFilterConfig{Limit: 1}},
+			want: []string{
+				`nginx_cache_size_bytes{type="max",zone="a"} 1.048576e+06`,
+				`nginx_cache_size_bytes{type="used",zone="a"} 4096`,
+				`nginx_cache_size_bytes{type="max",zone="__other__"} 6.291456e+06`,
+				`nginx_cache_size_bytes{type="used",zone="__other__"} 24576`,
+			},
+		},
+		{
+			// every counter has a different overCount, so that a counter
+			// corrected with the overCount of another one shows
+			name: "overCounts",
+			status: `{
+				"upstreamZones": {"app": [{
+					"server": "10.0.0.1:80", "requestCounter": 1, "inBytes": 4, "outBytes": 5,
+					"responses": {"2xx": 2, "5xx": 3},
+					"overCounts": {"maxIntegerSize": 4294967295, "requestCounter": 1, "2xx": 2, "5xx": 3, "inBytes": 4, "outBytes": 5}
+				}]},
+				"filterZones": {"country": {"BY": {
+					"requestCounter": 1, "inBytes": 3, "outBytes": 4,
+					"responses": {"4xx": 2},
+					"overCounts": {"maxIntegerSize": 4294967295, "requestCounter": 1, "4xx": 2, "inBytes": 3, "outBytes": 4}
+				}}},
+				"cacheZones": {"zone": {
+					"inBytes": 3, "outBytes": 4,
+					"responses": {"hit": 1, "miss": 2},
+					"overCounts": {"maxIntegerSize": 4294967295, "hit": 1, "miss": 2, "inBytes": 3, "outBytes": 4}
+				}}
+			}`,
+			want: []string{
+				`nginx_upstream_requests{backend="10.0.0.1:80",code="total",upstream="app"} 4.294967296e+09`,
+				`nginx_upstream_requests{backend="10.0.0.1:80",code="2xx",upstream="app"} 8.589934592e+09`,
+				`nginx_upstream_requests{backend="10.0.0.1:80",code="5xx",upstream="app"} 1.2884901888e+10`,
+				`nginx_upstream_bytes{backend="10.0.0.1:80",direction="in",upstream="app"} 1.7179869184e+10`,
+				`nginx_upstream_bytes{backend="10.0.0.1:80",direction="out",upstream="app"} 2.147483648e+10`,
+				`nginx_filter_requests{code="total",filter="country",filterName="BY"} 4.294967296e+09`,
+				`nginx_filter_requests{code="4xx",filter="country",filterName="BY"} 8.589934592e+09`,
+				`nginx_filter_bytes{direction="in",filter="country",filterName="BY"} 1.2884901888e+10`,
+				`nginx_filter_bytes{direction="out",filter="country",filterName="BY"} 1.7179869184e+10`,
+				`nginx_cache_requests{status="hit",zone="zone"} 4.294967296e+09`,
+				`nginx_cache_requests{status="miss",zone="zone"} 8.589934592e+09`,
+				`nginx_cache_bytes{direction="in",zone="zone"} 1.2884901888e+10`,
+				`nginx_cache_bytes{direction="out",zone="zone"} 1.7179869184e+10`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := fixtureExporter(t, tt.status)
+			if tt.zones.LimitAction != "" {
+				filters, err := newZoneFilters(tt.zones)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e.ZoneFilters = filters
+			}
+
+			lines := scrapeLines(t, e)
+			if !hasSample(lines, "nginx_up 1") {
+				t.Fatalf("scrape failed:\n%s", strings.Join(lines, "\n"))
+			}
+			for _, want := range tt.want {
+				if !slices.Contains(lines, want) {
+					t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestCollectStreamZones(t *testing.T) {
+	const status = `{
+		"streamServerZones": {
+			"TCP:1981:127.0.0.1": {
+				"port": 1981, "protocol": "TCP", "connectCounter": 10, "inBytes": 100, "outBytes": 200,
+				"responses": {"1xx": 0, "2xx": 9, "3xx": 0, "4xx": 0, "5xx": 1},
+				"sessionMsecCounter": 1500, "sessionMsec": 150,
+				"sessionBuckets": {"msecs": [100, 1000], "counters": [4, 6]},
+				"overCounts": {"maxIntegerSize": 18446744073709551615}
+			},
+			"UDP:53:127.0.0.1": {
+				"port": 53, "protocol": "UDP", "connectCounter": 3,
+				"responses": {"2xx": 3},
+				"overCounts": {"maxIntegerSize": 18446744073709551615, "connectCounter": 1}
+			}
+		},
+		"streamUpstreamZones": {
+			"backend": [{
+				"server": "127.0.0.1:8080", "connectCounter": 10, "inBytes": 100, "outBytes": 200,
+				"responses": {"2xx": 8, "5xx": 2},
+				"sessionMsecCounter": 2000, "sessionMsec": 200,
+				"sessionBuckets": {"msecs": [100], "counters": [10]},
+				"uSessionMsec": 190, "uConnectMsec": 1, "uFirstByteMsec": 5,
+				"weight": 2, "maxFails": 3, "failTimeout": 10, "backup": true, "down": false,
+				"overCounts": {"maxIntegerSize": 18446744073709551615}
+			}]
+		},
+		"streamFilterZones": {
+			"port": {
+				"1981": {"connectCounter": 4, "responses": {"2xx": 4}, "sessionMsec": 20, "overCounts": {"maxIntegerSize": 18446744073709551615}}
+			}
+		}
+	}`
+	lines := scrapeLines(t, fixtureExporter(t, status))
+	if !hasSample(lines, "nginx_up 1") {
+		t.Fatalf("scrape failed:\n%s", strings.Join(lines, "\n"))
+	}
+
+	for _, want := range []string{
+		// per-protocol server zones
+		`nginx_stream_server_connects{code="total",listen="TCP:1981:127.0.0.1",protocol="TCP"} 10`,
+		`nginx_stream_server_connects{code="2xx",listen="TCP:1981:127.0.0.1",protocol="TCP"} 9`,
+		`nginx_stream_server_connects{code="5xx",listen="TCP:1981:127.0.0.1",protocol="TCP"} 1`,
+		`nginx_stream_server_bytes{direction="in",listen="TCP:1981:127.0.0.1",protocol="TCP"} 100`,
+		`nginx_stream_server_bytes{direction="out",listen="TCP:1981:127.0.0.1",protocol="TCP"} 200`,
+		`nginx_stream_server_sessionMsec{listen="TCP:1981:127.0.0.1",protocol="TCP"} 150`,
+		`nginx_stream_server_session_duration_seconds_bucket{listen="TCP:1981:127.0.0.1",protocol="TCP",le="0.1"} 4`,
+		`nginx_stream_server_session_duration_seconds_bucket{listen="TCP:1981:127.0.0.1",protocol="TCP",le="1"} 10`,
+		`nginx_stream_server_session_duration_seconds_sum{listen="TCP:1981:127.0.0.1",protocol="TCP"} 1.5`,
+		`nginx_stream_server_session_duration_seconds_count{listen="TCP:1981:127.0.0.1",protocol="TCP"} 10`,
+		`nginx_stream_server_connects{code="total",listen="UDP:53:127.0.0.1",protocol="UDP"} 1.8446744073709552e+19`,
+		// upstream backends
+		`nginx_stream_upstream_connects{backend="127.0.0.1:8080",code="5xx",upstream="backend"} 2`,
+		`nginx_stream_upstream_bytes{backend="127.0.0.1:8080",direction="out",upstream="backend"} 200`,
+		`nginx_stream_upstream_sessionMsec{backend="127.0.0.1:8080",upstream="backend"} 200`,
+		`nginx_stream_upstream_upstreamSessionMsec{backend="127.0.0.1:8080",upstream="backend"} 190`,
+		`nginx_stream_upstream_upstreamConnectMsec{backend="127.0.0.1:8080",upstream="backend"} 1`,
+		`nginx_stream_upstream_upstreamFirstByteMsec{backend="127.0.0.1:8080",upstream="backend"} 5`,
+		`nginx_stream_upstream_session_duration_seconds_count{backend="127.0.0.1:8080",upstream="backend"} 10`,
+		`nginx_stream_upstream_peer_weight{backend="127.0.0.1:8080",upstream="backend"} 2`,
+		`nginx_stream_upstream_peer_max_fails{backend="127.0.0.1:8080",upstream="backend"} 3`,
+		`nginx_stream_upstream_peer_fail_timeout_seconds{backend="127.0.0.1:8080",upstream="backend"} 10`,
+		`nginx_stream_upstream_peer_backup{backend="127.0.0.1:8080",upstream="backend"} 1`,
+		`nginx_stream_upstream_peer_down{backend="127.0.0.1:8080",upstream="backend"} 0`,
+		// filter zones
+		`nginx_stream_filter_connects{code="2xx",filter="port",filterName="1981"} 4`,
+		`nginx_stream_filter_sessionMsec{filter="port",filterName="1981"} 20`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+	for _, absent := range []string{
+		// no buckets configured, or a wrapped session counter
+		`nginx_stream_server_session_duration_seconds_count{listen="UDP:53:127.0.0.1"`,
+		`nginx_stream_filter_session_duration_seconds`,
+	} {
+		if hasSample(lines, absent) {
+			t.Errorf("unexpected %s", absent)
+		}
+	}
+}
+
+func TestWriteMetricsUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		bodies []string
+		want   bool
+	}{
+		{name: "up", bodies: []string{`{}`}, want: true},
+		{name: "decode error", bodies: []string{`{`}, want: false},
+		{name: "one target down", bodies: []string{`{}`, `not json`}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var targets targetsCollector
+			for i, body := range tt.bodies {
+				targets = append(targets, NewExporter("nginx", newTestNginx(t, body).URL, prometheus.Labels{"target": fmt.Sprint(i)}))
+			}
+
+			var b bytes.Buffer
+			up, err := writeMetrics(&b, targets, "nginx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if up != tt.want {
+				t.Errorf("up = %t, want %t", up, tt.want)
+			}
+		})
+	}
+}
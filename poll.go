@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// poller is a collector that can poll nginx in the background.
+type poller interface {
+	startPolling()
+	stopPolling()
+}
+
+// snapshot is a successfully polled status page.
+type snapshot struct {
+	// vts holds the decoded vts or stub_status page
+	vts *NginxVts
+	// data holds the page of the prometheus source type
+	data []byte
+	time time.Time
+}
+
+// startPolling polls nginx every PollInterval until stopPolling, so that
+// collections are served from the last good snapshot. The first poll is
+// done before it returns, so that collections never wait for one. It does
+// nothing if PollInterval is 0.
+func (e *Exporter) startPolling() {
+	if e.PollInterval <= 0 {
+		return
+	}
+
+	e.pollOnce()
+	ctx, cancel := context.WithCancel(context.Background())
+	e.pollMu.Lock()
+	e.stopPoll = cancel
+	e.pollMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(e.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			e.pollOnce()
+		}
+	}()
+}
+
+func (e *Exporter) stopPolling() {
+	e.pollMu.Lock()
+	defer e.pollMu.Unlock()
+	if e.stopPoll != nil {
+		e.stopPoll()
+	}
+}
+
+// polling reports whether collections are served from polled snapshots.
+func (e *Exporter) polling() bool {
+	e.pollMu.Lock()
+	defer e.pollMu.Unlock()
+	return e.stopPoll != nil
+}
+
+func (e *Exporter) pollOnce() {
+	start := time.Now()
+	s, stage, err := e.poll()
+	if err != nil {
+		log.Println(stage, "failed", err)
+		e.scrapeErrors.WithLabelValues(stage).Inc()
+	}
+
+	if err == nil {
+		s.time = start
+		// collections select the zones of the snapshot again without
+		// counting them, so dropped zones are counted once per poll
+		e.countDroppedZones(s)
+	}
+
+	e.pollMu.Lock()
+	defer e.pollMu.Unlock()
+	e.lastPoll = &scrapeResult{err: err, time: start, duration: time.Since(start)}
+	if err == nil {
+		e.previous, e.snapshot = e.snapshot, s
+	}
+}
+
+// countDroppedZones counts the zones of s that collections drop.
+func (e *Exporter) countDroppedZones(s *snapshot) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		e.collectSnapshot(ch, s, true)
+		close(ch)
+	}()
+	for range ch {
+	}
+}
+
+// poll fetches and decodes the status page. Unlike scrape, it keeps the
+// decoded page rather than sending its metrics.
+func (e *Exporter) poll() (*snapshot, string, error) {
+	body, err := e.fetch()
+	if err != nil {
+		return nil, stageFetch, err
+	}
+	defer body.Close()
+
+	r := &bodyReader{r: body, limit: e.MaxBodySize}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, r.stage(err), err
+	}
+
+	s := &snapshot{}
+	switch e.SourceType {
+	case sourceStubStatus:
+		connections, err := parseStubStatus(data)
+		if err != nil {
+			return nil, stageDecode, err
+		}
+		s.vts = &NginxVts{Connections: connections}
+	case sourcePrometheus:
+		var parser expfmt.TextParser
+		if _, err := parser.TextToMetricFamilies(bytes.NewReader(data)); err != nil {
+			return nil, stageDecode, err
+		}
+		s.data = data
+	default:
+		s.vts = &NginxVts{}
+		if err := json.Unmarshal(stripJSONP(data, e.JSONPCallback), s.vts); err != nil {
+			return nil, stageDecode, err
+		}
+	}
+	return s, "", nil
+}
+
+// collectPolled sends the metrics of the last good snapshot to ch, marked
+// stale when the last poll failed, and returns the last poll.
+func (e *Exporter) collectPolled(ch chan<- prometheus.Metric) *scrapeResult {
+	e.pollMu.Lock()
+	s, previous, lastPoll := e.snapshot, e.previous, e.lastPoll
+	e.pollMu.Unlock()
+
+	if s == nil {
+		return lastPoll
+	}
+
+	e.collectSnapshot(ch, s, false)
+	if e.SourceType == sourceVts && e.DerivedMetrics && previous != nil {
+		e.collectDerived(ch, previous, s)
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.lastPollMetric, prometheus.GaugeValue, float64(s.time.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(e.staleMetric, prometheus.GaugeValue, boolValue(lastPoll.err != nil))
+	return lastPoll
+}
+
+// collectSnapshot sends the metrics of the polled page s to ch, counting
+// the zones it drops if countDropped is set.
+func (e *Exporter) collectSnapshot(ch chan<- prometheus.Metric, s *snapshot, countDropped bool) {
+	switch e.SourceType {
+	case sourceStubStatus:
+		e.collectConnections(ch, s.vts.Connections)
+	case sourcePrometheus:
+		if err := e.collectPrometheus(ch, s.data, countDropped); err != nil {
+			log.Println("collecting polled snapshot failed", err)
+		}
+	default:
+		e.collectVts(ch, s.vts, countDropped)
+	}
+}
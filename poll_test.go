@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollSnapshot(t *testing.T) {
+	nginx := newTestNginx(t, `{"serverZones": {"a": {"requestCounter": 3}}}`)
+	e := NewExporter("nginx", nginx.URL, nil)
+	// polls are done by hand
+	e.PollInterval = time.Hour
+	e.startPolling()
+	defer e.stopPolling()
+
+	// the first poll is done by startPolling
+	lines := scrapeLines(t, e)
+	for _, want := range []string{
+		"nginx_up 1",
+		"nginx_exporter_snapshot_stale 0",
+		`nginx_server_requests{code="total",host="a"} 3`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("first collection: missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+	polled, ok := sampleValue(lines, "nginx_exporter_last_successful_poll_timestamp_seconds")
+	if !ok {
+		t.Fatal("missing nginx_exporter_last_successful_poll_timestamp_seconds")
+	}
+	if n := nginx.requests.Load(); n != 1 {
+		t.Errorf("nginx was requested %d times, want 1", n)
+	}
+
+	// collections are served from the snapshot
+	scrapeLines(t, e)
+	if n := nginx.requests.Load(); n != 1 {
+		t.Errorf("collection requested nginx, %d requests", n)
+	}
+
+	// a failed poll keeps serving the last good snapshot, marked stale
+	nginx.fail.Store(true)
+	e.pollOnce()
+	lines = scrapeLines(t, e)
+	for _, want := range []string{
+		"nginx_up 0",
+		"nginx_exporter_snapshot_stale 1",
+		`nginx_exporter_scrape_errors_total{stage="fetch"} 1`,
+		`nginx_server_requests{code="total",host="a"} 3`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("after failed poll: missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+	if got, _ := sampleValue(lines, "nginx_exporter_last_successful_poll_timestamp_seconds"); got != polled {
+		t.Errorf("last successful poll = %s after a failed poll, want %s", got, polled)
+	}
+
+	// and the next good poll replaces it
+	nginx.fail.Store(false)
+	e.pollOnce()
+	lines = scrapeLines(t, e)
+	for _, want := range []string{"nginx_up 1", "nginx_exporter_snapshot_stale 0"} {
+		if !hasSample(lines, want) {
+			t.Errorf("after recovery: missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+	if got, _ := sampleValue(lines, "nginx_exporter_last_successful_poll_timestamp_seconds"); got == polled {
+		t.Error("last successful poll not updated after recovery")
+	}
+}
+
+func TestPollFirstPollFails(t *testing.T) {
+	nginx := newTestNginx(t, `{}`)
+	nginx.fail.Store(true)
+	e := NewExporter("nginx", nginx.URL, nil)
+	e.PollInterval = time.Hour
+	e.startPolling()
+	defer e.stopPolling()
+
+	lines := scrapeLines(t, e)
+	for _, want := range []string{"nginx_up 0", `nginx_exporter_scrape_errors_total{stage="fetch"} 1`} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+	// there is no snapshot to be stale
+	for _, absent := range []string{"nginx_exporter_snapshot_stale", "nginx_exporter_last_successful_poll_timestamp_seconds"} {
+		if hasSample(lines, absent) {
+			t.Errorf("unexpected %s", absent)
+		}
+	}
+}
+
+func TestPollDroppedZones(t *testing.T) {
+	nginx := newTestNginx(t, `{"serverZones": {"a": {}, "b": {}}}`)
+	filters, err := newZoneFilters(ZonesConfig{LimitAction: limitDrop, Server: ZoneFilterConfig{Exclude: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter("nginx", nginx.URL, nil)
+	e.ZoneFilters = filters
+	e.PollInterval = time.Hour
+	e.startPolling()
+	defer e.stopPolling()
+
+	// dropped zones are counted by polls, not by collections
+	for polls := 1; polls <= 2; polls++ {
+		if polls > 1 {
+			e.pollOnce()
+		}
+		for i := 0; i < 3; i++ {
+			lines := scrapeLines(t, e)
+			want := fmt.Sprintf(`nginx_exporter_dropped_zones_total{kind="server"} %d`, polls)
+			if !hasSample(lines, want) {
+				t.Fatalf("after %d polls: missing %s in\n%s", polls, want, strings.Join(lines, "\n"))
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler scrapes the vts status page given by the target query
+// parameter, in the style of blackbox_exporter's /probe endpoint.
+func probeHandler(newExporter func(uri string) (*Exporter, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		// targets come from unauthenticated requests, so they must not
+		// reach local files or sockets
+		if target == stdinURI || strings.HasPrefix(target, fileScheme) || strings.HasPrefix(target, unixScheme) {
+			http.Error(w, "target must be an http(s):// URI", http.StatusBadRequest)
+			return
+		}
+
+		timeout, err := probeTimeout(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		exporter, err := newExporter(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		exporter.Timeout = timeout
+		if sourceType := r.URL.Query().Get("source_type"); sourceType != "" {
+			if err := validateSourceType(sourceType); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			exporter.SourceType = sourceType
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exporter)
+
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+
+		// the exporter and its transport are discarded after the probe
+		if t, ok := exporter.Transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// probeTimeout returns the timeout announced by Prometheus in the
+// X-Prometheus-Scrape-Timeout-Seconds header minus probe.timeout_offset,
+// falling back to nginx.scrape_timeout when the header is absent. A timeout
+// that is not positive would turn the client timeout off, so it is rejected.
+func probeTimeout(r *http.Request) (time.Duration, error) {
+	timeout := time.Duration(*nginxScrapeTimeout) * time.Second
+
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse timeout from Prometheus header: %w", err)
+		}
+		if math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+			return 0, fmt.Errorf("invalid timeout %q in Prometheus header", v)
+		}
+		if seconds > *probeTimeoutOffset {
+			seconds -= *probeTimeoutOffset
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+		if timeout <= 0 {
+			return 0, fmt.Errorf("timeout %q from Prometheus header must be positive", v)
+		}
+	}
+
+	return timeout, nil
+}
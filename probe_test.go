@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHandlerTargets(t *testing.T) {
+	nginx := newTestNginx(t, `{"hostName": "nginx-1", "nginxVersion": "1.25.0"}`)
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{target: "", want: http.StatusBadRequest},
+		{target: "-", want: http.StatusBadRequest},
+		{target: "file:///etc/passwd", want: http.StatusBadRequest},
+		{target: "unix:///var/run/docker.sock:/containers/json", want: http.StatusBadRequest},
+		{target: nginx.URL + "/status/format/json", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var probed []string
+			handler := probeHandler(func(uri string) (*Exporter, error) {
+				probed = append(probed, uri)
+				return NewExporter("nginx", uri, nil), nil
+			})
+
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape(tt.target), nil))
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				if len(probed) != 0 {
+					t.Errorf("rejected target %q was probed", tt.target)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), "nginx_up 1") {
+				t.Errorf("probe of %q did not succeed:\n%s", tt.target, w.Body)
+			}
+		})
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	savedTimeout, savedOffset := *nginxScrapeTimeout, *probeTimeoutOffset
+	defer func() { *nginxScrapeTimeout, *probeTimeoutOffset = savedTimeout, savedOffset }()
+	*nginxScrapeTimeout = 2
+	*probeTimeoutOffset = 0.5
+
+	tests := []struct {
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{header: "", want: 2 * time.Second},
+		{header: "10", want: 9500 * time.Millisecond},
+		{header: "1.5", want: time.Second},
+		{header: "0.25", want: 250 * time.Millisecond},
+		{header: "0", wantErr: true},
+		{header: "-5", wantErr: true},
+		{header: "1e-12", wantErr: true},
+		{header: "NaN", wantErr: true},
+		{header: "+Inf", wantErr: true},
+		{header: "ten", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/probe", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+			}
+			got, err := probeTimeout(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probeTimeout() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("probeTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerInvalidTimeout(t *testing.T) {
+	handler := probeHandler(func(uri string) (*Exporter, error) {
+		t.Errorf("%q was probed", uri)
+		return NewExporter("nginx", uri, nil), nil
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape("http://nginx/status"), nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
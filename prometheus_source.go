@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// nativeMetric maps a native vts metric to the metric of the JSON source,
+// so that both source types export the same schema.
+type nativeMetric struct {
+	desc func(e *Exporter) *prometheus.Desc
+	// labels are the native labels in the order of the labels of desc.
+	// Alternatives are separated by |, and helpZone is the shared zone name
+	// given in the help text.
+	labels []string
+	// values renames label values
+	values map[string]string
+	// scale converts the native unit, e.g. seconds to milliseconds
+	scale float64
+}
+
+const helpZone = "[help]"
+
+// nativeMetrics maps the native vts metric names, without namespace, to the
+// metrics of the JSON source.
+var nativeMetrics = map[string]nativeMetric{
+	"info": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.infoMetric },
+		labels: []string{"hostname", "version"},
+	},
+	"main_connections": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["connections"] },
+		labels: []string{"status"},
+	},
+	"main_shm_usage_bytes": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["sharedzones"] },
+		labels: []string{helpZone, "shared"},
+		values: map[string]string{"max_size": "maxsize", "used_size": "usedsize", "used_node": "usednode"},
+	},
+	"server_requests_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["requests"] },
+		labels: []string{"host", "code"},
+	},
+	"server_bytes_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["bytes"] },
+		labels: []string{"host", "direction"},
+	},
+	"server_cache_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["cache"] },
+		labels: []string{"host", "status"},
+	},
+	"server_request_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["requestMsec"] },
+		labels: []string{"host"},
+		scale:  1000,
+	},
+	"server_request_duration_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.serverMetrics["requestDuration"] },
+		labels: []string{"host"},
+	},
+	"upstream_requests_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.upstreamMetrics["requests"] },
+		labels: []string{"upstream", "code", "backend"},
+	},
+	"upstream_bytes_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.upstreamMetrics["bytes"] },
+		labels: []string{"upstream", "direction", "backend"},
+	},
+	"upstream_response_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.upstreamMetrics["responseMsec"] },
+		labels: []string{"upstream", "backend"},
+		scale:  1000,
+	},
+	"upstream_request_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.upstreamMetrics["requestMsec"] },
+		labels: []string{"upstream", "backend"},
+		scale:  1000,
+	},
+	"upstream_request_duration_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.upstreamMetrics["requestDuration"] },
+		labels: []string{"upstream", "backend"},
+	},
+	// vts labels the response class of filter requests as direction
+	"filter_requests_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.filterMetrics["requests"] },
+		labels: []string{"filter", "filter_name", "code|direction"},
+	},
+	"filter_bytes_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.filterMetrics["bytes"] },
+		labels: []string{"filter", "filter_name", "direction"},
+	},
+	"filter_response_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.filterMetrics["responseMsec"] },
+		labels: []string{"filter", "filter_name"},
+		scale:  1000,
+	},
+	"filter_request_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.filterMetrics["requestMsec"] },
+		labels: []string{"filter", "filter_name"},
+		scale:  1000,
+	},
+	"filter_request_duration_seconds": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.filterMetrics["requestDuration"] },
+		labels: []string{"filter", "filter_name"},
+	},
+	"cache_requests_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.cacheMetrics["requests"] },
+		labels: []string{"cache_zone", "status"},
+	},
+	"cache_bytes_total": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.cacheMetrics["bytes"] },
+		labels: []string{"cache_zone", "direction"},
+	},
+	"cache_usage_bytes": {
+		desc:   func(e *Exporter) *prometheus.Desc { return e.cacheMetrics["size"] },
+		labels: []string{"cache_zone", "cache_size"},
+	},
+}
+
+// nativeLabels renames the labels of native metrics without a JSON
+// counterpart to the labels of the JSON source. RenameLabels takes
+// precedence.
+var nativeLabels = map[string]string{
+	"filter_name": "filterName",
+	"cache_zone":  "zone",
+	"hostname":    "hostName",
+	"version":     "nginxVersion",
+}
+
+// helpZoneRE extracts the zone name from help texts like
+// "Shared memory [ngx_http_vhost_traffic_status] info".
+var helpZoneRE = regexp.MustCompile(`\[(.*)\]`)
+
+// collectPrometheus re-exposes the native output of vts in
+// /status/format/prometheus. Metrics known from the JSON source are
+// exported under the same names and labels, see nativeMetrics. Other metrics
+// in PrometheusNamespace are moved to the exporter namespace with labels
+// renamed by RenameLabels and nativeLabels. Zone filters are applied by the
+// zone label of each kind, counting dropped zones if countDropped is set.
+// Nothing is sent unless the whole page converts.
+func (e *Exporter) collectPrometheus(ch chan<- prometheus.Metric, data []byte, countDropped bool) error {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	// the info metric of the JSON source has the uptime in seconds as value
+	info, start := families[e.PrometheusNamespace+"_info"], families[e.PrometheusNamespace+"_start_time_seconds"]
+	if info != nil && start != nil && len(start.GetMetric()) == 1 {
+		startTime := start.GetMetric()[0].GetGauge().GetValue()
+		uptime := math.Floor(float64(time.Now().UnixMilli())/1000 - startTime)
+		for _, m := range info.GetMetric() {
+			m.Gauge = &dto.Gauge{Value: &uptime}
+		}
+	}
+
+	// zone filters and limits apply to the set of zones of each kind
+	zones := map[string]map[string]bool{}
+	for name, mf := range families {
+		for _, m := range mf.GetMetric() {
+			if kind, zone, ok := e.prometheusZone(name, m); ok {
+				if zones[kind] == nil {
+					zones[kind] = map[string]bool{}
+				}
+				zones[kind][zone] = true
+			}
+		}
+	}
+	selected := map[string]map[string]bool{}
+	for _, kind := range zoneKinds {
+		names, other := e.selectZones(kind, sortedKeys(zones[kind]), countDropped)
+		// native metrics cannot be aggregated, so limit_action fold drops too
+		if countDropped && len(other) > 0 {
+			e.droppedZones.WithLabelValues(kind).Add(float64(len(other)))
+		}
+		selected[kind] = map[string]bool{}
+		for _, zone := range names {
+			selected[kind][zone] = true
+		}
+	}
+
+	var metrics []prometheus.Metric
+	for _, name := range sortedKeys(families) {
+		mf := families[name]
+		for _, m := range mf.GetMetric() {
+			if kind, zone, ok := e.prometheusZone(name, m); ok && !selected[kind][zone] {
+				continue
+			}
+			metric, err := e.prometheusMetric(name, mf, m)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+
+	for _, m := range metrics {
+		ch <- m
+	}
+	return nil
+}
+
+// prometheusZone returns the zone kind and name of a native vts metric, e.g.
+// server and example.com for nginx_vts_server_requests_total{host="example.com"}.
+func (e *Exporter) prometheusZone(name string, m *dto.Metric) (kind, zone string, ok bool) {
+	rest, ok := strings.CutPrefix(name, e.PrometheusNamespace+"_")
+	if !ok {
+		return "", "", false
+	}
+	subsystem, _, _ := strings.Cut(rest, "_")
+
+	labels := map[string]string{}
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+
+	switch subsystem {
+	case kindServer:
+		zone, ok = labels["host"]
+	case kindUpstream:
+		zone, ok = labels["upstream"]
+	case kindFilter:
+		var filter, filterName string
+		if filter, ok = labels["filter"]; ok {
+			filterName, ok = labels["filter_name"]
+		}
+		zone = filter + "::" + filterName
+	case kindCache:
+		zone, ok = labels["cache_zone"]
+	default:
+		return "", "", false
+	}
+	return subsystem, zone, ok
+}
+
+// prometheusMetric converts a parsed metric to a const metric in the
+// exporter namespace, with the exporter const labels.
+func (e *Exporter) prometheusMetric(name string, mf *dto.MetricFamily, m *dto.Metric) (prometheus.Metric, error) {
+	rest, ok := strings.CutPrefix(name, e.PrometheusNamespace+"_")
+	if native, known := nativeMetrics[rest]; ok && known {
+		return e.nativeMetric(name, native, mf, m)
+	}
+	if ok {
+		name = prometheus.BuildFQName(e.namespace, "", rest)
+	}
+
+	labelNames := make([]string, 0, len(m.GetLabel()))
+	labelValues := make([]string, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		labelName := l.GetName()
+		if renamed, ok := e.RenameLabels[labelName]; ok {
+			labelName = renamed
+		} else if renamed, ok := nativeLabels[labelName]; ok {
+			labelName = renamed
+		}
+		labelNames = append(labelNames, labelName)
+		labelValues = append(labelValues, l.GetValue())
+	}
+	return constMetric(prometheus.NewDesc(name, mf.GetHelp(), labelNames, e.constLabels), mf.GetType(), m, 1, labelValues)
+}
+
+// nativeMetric converts a parsed metric to the metric of the JSON source
+// given by native.
+func (e *Exporter) nativeMetric(name string, native nativeMetric, mf *dto.MetricFamily, m *dto.Metric) (prometheus.Metric, error) {
+	labels := map[string]string{}
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if match := helpZoneRE.FindStringSubmatch(mf.GetHelp()); match != nil {
+		labels[helpZone] = match[1]
+	}
+
+	labelValues := make([]string, 0, len(native.labels))
+	for _, alternatives := range native.labels {
+		value, found := "", false
+		for _, label := range strings.Split(alternatives, "|") {
+			if value, found = labels[label]; found {
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s has no %s label", name, alternatives)
+		}
+		if renamed, ok := native.values[value]; ok {
+			value = renamed
+		}
+		labelValues = append(labelValues, value)
+	}
+
+	scale := native.scale
+	if scale == 0 {
+		scale = 1
+	}
+	return constMetric(native.desc(e), mf.GetType(), m, scale, labelValues)
+}
+
+// constMetric returns the value of m, of type t, as a const metric of desc.
+// Counter, gauge and untyped values are multiplied by scale.
+func constMetric(desc *prometheus.Desc, t dto.MetricType, m *dto.Metric, scale float64, labelValues []string) (prometheus.Metric, error) {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue()*scale, labelValues...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue()*scale, labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		buckets := make(map[float64]uint64, len(h.GetBucket()))
+		for _, b := range h.GetBucket() {
+			buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, h.GetSampleCount(), h.GetSampleSum(), buckets, labelValues...)
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		quantiles := make(map[float64]float64, len(s.GetQuantile()))
+		for _, q := range s.GetQuantile() {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, s.GetSampleCount(), s.GetSampleSum(), quantiles, labelValues...)
+	default:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue()*scale, labelValues...)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// nginxSamples returns the samples of lines that are not exporter metrics.
+func nginxSamples(lines []string) map[string]bool {
+	samples := map[string]bool{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "nginx_exporter_") && !strings.HasPrefix(line, "nginx_up ") {
+			samples[line] = true
+		}
+	}
+	return samples
+}
+
+// TestCollectPrometheusSchema checks that the native format of a status page
+// is exported like the JSON format of the same page.
+func TestCollectPrometheusSchema(t *testing.T) {
+	e := fixtureExporter(t, readFixture(t, "vts_native.json"))
+	jsonSamples := nginxSamples(scrapeLines(t, e))
+
+	e = fixtureExporter(t, readFixture(t, "vts_native.prom"))
+	e.SourceType = sourcePrometheus
+	lines := scrapeLines(t, e)
+	if !hasSample(lines, "nginx_up 1") {
+		t.Fatalf("scrape failed:\n%s", strings.Join(lines, "\n"))
+	}
+	nativeSamples := nginxSamples(lines)
+
+	// not in the native format
+	jsonOnly := []string{"nginx_upstream_peer_", "nginx_filter_responseMsec", "nginx_server_info"}
+	// not in the JSON format, exported with prefix and label renaming
+	nativeOnly := []string{
+		"nginx_start_time_seconds",
+		`nginx_server_request_seconds_total{host="example.com"}`,
+		`nginx_filter_request_seconds_total{filter="country",filterName="US"}`,
+		`nginx_upstream_request_seconds_total{backend="10.0.0.1:80",upstream="backend"}`,
+		`nginx_upstream_response_seconds_total{backend="10.0.0.1:80",upstream="backend"}`,
+		`nginx_upstream_response_duration_seconds_`,
+	}
+	hasPrefix := func(line string, prefixes []string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(line, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for line := range jsonSamples {
+		if !nativeSamples[line] && !hasPrefix(line, jsonOnly) {
+			t.Errorf("missing from native format: %s", line)
+		}
+	}
+	for line := range nativeSamples {
+		if !jsonSamples[line] && !hasPrefix(line, append(nativeOnly, "nginx_server_info")) {
+			t.Errorf("not in JSON format: %s", line)
+		}
+	}
+	if !hasSample(lines, `nginx_server_info{hostName="web-1",nginxVersion="1.25.3"}`) {
+		t.Error("missing nginx_server_info")
+	}
+	for _, want := range nativeOnly {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+// TestCollectPrometheusMixedTargets checks that JSON and native targets can
+// be gathered together, which requires the same help and label names.
+func TestCollectPrometheusMixedTargets(t *testing.T) {
+	native := NewExporter("nginx", newTestNginx(t, readFixture(t, "vts_native.prom")).URL, prometheus.Labels{"target": "native"})
+	native.SourceType = sourcePrometheus
+	targets := targetsCollector{
+		NewExporter("nginx", newTestNginx(t, readFixture(t, "vts_native.json")).URL, prometheus.Labels{"target": "json"}),
+		native,
+	}
+
+	lines := scrapeLines(t, targets)
+	for _, want := range []string{
+		`nginx_server_requests{code="total",host="example.com",target="json"} 10`,
+		`nginx_server_requests{code="total",host="example.com",target="native"} 10`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestCollectPrometheusZones(t *testing.T) {
+	filters, err := newZoneFilters(ZonesConfig{
+		LimitAction: limitFold,
+		Server:      ZoneFilterConfig{Exclude: `example\.com`},
+		Filter:      ZoneFilterConfig{Exclude: `country::US`},
+		Cache:       ZoneFilterConfig{Exclude: `static`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fixtureExporter(t, readFixture(t, "vts_native.prom"))
+	e.SourceType = sourcePrometheus
+	e.ZoneFilters = filters
+	e.RenameLabels = map[string]string{"backend": "peer"}
+	lines := scrapeLines(t, e)
+
+	for _, absent := range []string{"nginx_server_requests{", "nginx_filter_", "nginx_cache_", "nginx_server_request_seconds_total"} {
+		if hasSample(lines, absent) {
+			t.Errorf("unexpected %s", absent)
+		}
+	}
+	for _, want := range []string{
+		`nginx_server_connections{status="active"} 1`,
+		`nginx_upstream_requests{backend="10.0.0.1:80",code="total",upstream="backend"} 9`,
+		// rename_labels applies to metrics without a JSON counterpart
+		`nginx_upstream_response_seconds_total{peer="10.0.0.1:80",upstream="backend"} 0.036`,
+		`nginx_exporter_dropped_zones_total{kind="server"} 1`,
+		`nginx_exporter_dropped_zones_total{kind="filter"} 1`,
+		`nginx_exporter_dropped_zones_total{kind="cache"} 1`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestCollectPrometheusErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "invalid", data: "nginx_vts_server_requests_total{host=\"a\" 1\n"},
+		{name: "missing label", data: "# TYPE nginx_vts_server_requests_total counter\nnginx_vts_server_requests_total{host=\"a\"} 1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := fixtureExporter(t, tt.data)
+			e.SourceType = sourcePrometheus
+			lines := scrapeLines(t, e)
+			if !hasSample(lines, "nginx_up 0") {
+				t.Errorf("scrape succeeded:\n%s", strings.Join(lines, "\n"))
+			}
+			if hasSample(lines, "nginx_server_requests") {
+				t.Error("metrics of a failed page were exported")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+)
+
+var pushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "nginx_vts_exporter",
+	Name:      "push_errors_total",
+	Help:      "Number of pushes to the Pushgateway that failed after all retries.",
+})
+
+// pushBackoff is the wait before the first retry of a push.
+var pushBackoff = time.Second
+
+func init() {
+	prometheus.MustRegister(pushErrors)
+}
+
+// newPusher returns a pusher of the metrics of c and the exporter's own
+// push errors to -push.url.
+func newPusher(c prometheus.Collector) (*push.Pusher, error) {
+	if *pushJob == "" {
+		return nil, errors.New("push job must not be empty")
+	}
+	if *pushInterval <= 0 {
+		return nil, errors.New("push interval must be positive")
+	}
+	auth := AuthConfig{}
+	if *pushUsername != "" || *pushPasswordFile != "" {
+		auth.BasicAuth = &config.BasicAuth{Username: *pushUsername, PasswordFile: *pushPasswordFile}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c, pushErrors)
+
+	p := push.New(*pushURL, *pushJob).
+		Gatherer(registry).
+		Client(&http.Client{Transport: auth.roundTripper(nil), Timeout: *pushTimeout})
+	for _, name := range sortedKeys(pushGrouping) {
+		p.Grouping(name, pushGrouping[name])
+	}
+	return p, nil
+}
+
+// runPusher pushes every -push.interval until ctx is done. A failed push
+// is retried up to -push.retries times, waiting twice as long each time
+// but never past the next push.
+func runPusher(ctx context.Context, p *push.Pusher) {
+	ticker := time.NewTicker(*pushInterval)
+	defer ticker.Stop()
+	for {
+		if err := pushWithRetries(ctx, p); err != nil {
+			log.Println("push to", *pushURL, "failed", err)
+			pushErrors.Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pushWithRetries(ctx context.Context, p *push.Pusher) error {
+	deadline := time.Now().Add(*pushInterval)
+	backoff := pushBackoff
+	for retry := 0; ; retry++ {
+		// Push replaces the whole group, so zones gone from nginx are
+		// removed from the Pushgateway as well.
+		err := p.PushContext(ctx)
+		if err == nil || retry == *pushRetries || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Println("push to", *pushURL, "failed, retrying", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// labelFlags collects repeated -push.grouping "name=value" flags.
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	labels := make([]string, 0, len(l))
+	for _, name := range sortedKeys(l) {
+		labels = append(labels, name+"="+l[name])
+	}
+	return strings.Join(labels, ", ")
+}
+
+func (l labelFlags) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || !model.LabelName(name).IsValid() {
+		return fmt.Errorf("invalid label %q, must be \"name=value\"", value)
+	}
+	l[name] = v
+	return nil
+}
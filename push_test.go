@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type pushRequest struct {
+	path, authorization, body string
+}
+
+// fakePushgateway fails the first failures pushes with 500.
+type fakePushgateway struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	pushes   []pushRequest
+}
+
+func newFakePushgateway(t *testing.T, failures int) *fakePushgateway {
+	t.Helper()
+	g := &fakePushgateway{failures: failures}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.pushes = append(g.pushes, pushRequest{path: r.URL.Path, authorization: r.Header.Get("Authorization"), body: string(body)})
+		if len(g.pushes) <= g.failures {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakePushgateway) requests() []pushRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]pushRequest(nil), g.pushes...)
+}
+
+func pushErrorsValue(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := pushErrors.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestPushWithRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		interval     time.Duration
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", failures: 0, retries: 3, interval: time.Minute, wantAttempts: 1},
+		{name: "retried", failures: 2, retries: 3, interval: time.Minute, wantAttempts: 3},
+		{name: "out of retries", failures: 5, retries: 3, interval: time.Minute, wantAttempts: 4, wantErr: true},
+		{name: "no retries", failures: 1, retries: 0, interval: time.Minute, wantAttempts: 1, wantErr: true},
+		// retries wait 10ms then 20ms, and the second wait would end past
+		// the next push 25ms after the first
+		{name: "next push", failures: 5, retries: 5, interval: 25 * time.Millisecond, wantAttempts: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := newFakePushgateway(t, tt.failures)
+			setVar(t, pushURL, gateway.URL)
+			setVar(t, pushRetries, tt.retries)
+			setVar(t, pushInterval, tt.interval)
+			setVar(t, &pushBackoff, 10*time.Millisecond)
+
+			p, err := newPusher(prometheus.NewCounter(prometheus.CounterOpts{Name: "pushed_total", Help: "test"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = pushWithRetries(context.Background(), p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pushWithRetries() error = %v, want error %t", err, tt.wantErr)
+			}
+			if n := len(gateway.requests()); n != tt.wantAttempts {
+				t.Errorf("%d push attempts, want %d", n, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRunPusherErrors(t *testing.T) {
+	gateway := newFakePushgateway(t, 2)
+	setVar(t, pushURL, gateway.URL)
+	setVar(t, pushRetries, 0)
+	setVar(t, pushInterval, 10*time.Millisecond)
+
+	p, err := newPusher(prometheus.NewCounter(prometheus.CounterOpts{Name: "pushed_total", Help: "test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := pushErrorsValue(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runPusher(ctx, p)
+		close(done)
+	}()
+	for len(gateway.requests()) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// the two failed pushes are counted, and pushed along with the metrics
+	if got := pushErrorsValue(t) - before; got != 2 {
+		t.Errorf("push_errors_total grew by %v, want 2", got)
+	}
+	last := gateway.requests()[len(gateway.requests())-1]
+	for _, want := range []string{"pushed_total", "nginx_vts_exporter_push_errors_total"} {
+		if !strings.Contains(last.body, want) {
+			t.Errorf("push does not have %s", want)
+		}
+	}
+}
+
+func TestNewPusherGroupingAndAuth(t *testing.T) {
+	gateway := newFakePushgateway(t, 0)
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, pushURL, gateway.URL)
+	setVar(t, &pushGrouping, labelFlags{"instance": "web1", "dc": "eu"})
+	setVar(t, pushUsername, "pusher")
+	setVar(t, pushPasswordFile, passwordFile)
+
+	p, err := newPusher(prometheus.NewCounter(prometheus.CounterOpts{Name: "pushed_total", Help: "test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pushWithRetries(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Pushgateway takes grouping labels in any order
+	push := gateway.requests()[0]
+	grouping, ok := strings.CutPrefix(push.path, "/metrics/job/nginx_vts_exporter/")
+	pairs := strings.Split(grouping, "/")
+	labels := map[string]string{}
+	for i := 0; ok && i+1 < len(pairs); i += 2 {
+		labels[pairs[i]] = pairs[i+1]
+	}
+	if !ok || len(pairs) != 4 || labels["dc"] != "eu" || labels["instance"] != "web1" {
+		t.Errorf("pushed to %s, want job nginx_vts_exporter grouped by dc=eu and instance=web1", push.path)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("pusher:secret")); push.authorization != want {
+		t.Errorf("Authorization = %q, want %q", push.authorization, want)
+	}
+}
+
+func TestNewPusherErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		job      string
+		interval time.Duration
+	}{
+		{name: "empty job", job: "", interval: time.Second},
+		{name: "zero interval", job: "nginx", interval: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, pushJob, tt.job)
+			setVar(t, pushInterval, tt.interval)
+			if _, err := newPusher(prometheus.NewCounter(prometheus.CounterOpts{Name: "pushed_total", Help: "test"})); err == nil {
+				t.Error("newPusher() succeeded")
+			}
+		})
+	}
+}
+
+func TestLabelFlags(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: "dc=eu"},
+		{value: "dc="},
+		{value: "path=a=b"},
+		{value: "dc", wantErr: true},
+		{value: "=eu", wantErr: true},
+		{value: "data-center=eu", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			l := labelFlags{}
+			err := l.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if err == nil {
+				name, value, _ := strings.Cut(tt.value, "=")
+				if l[name] != value {
+					t.Errorf("Set(%q) = %v", tt.value, l)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/config"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nginx_vts_exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nginx_vts_exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+// errReloadSkipped is returned by reload without -config.file, when there
+// is nothing to reload.
+var errReloadSkipped = errors.New("reloads are skipped without -config.file")
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+}
+
+// reloadableCollector forwards to the collector built from the current
+// configuration, which is swapped atomically on reload. The metrics it
+// exposes change with the configuration, so it is an unchecked collector.
+type reloadableCollector struct {
+	mu          sync.RWMutex
+	collector   prometheus.Collector
+	namespace   string
+	zoneFilters map[string]*zoneFilter
+
+	// swapMu serializes swaps, which may wait for the first poll of the new
+	// collector, without blocking collections meanwhile
+	swapMu sync.Mutex
+	// polling is set once the collectors may poll in the background
+	polling bool
+}
+
+// reload rebuilds the collector from -config.file, or from the flags when
+// no config file is given. On error the previous collector is kept. Flags
+// cannot change at runtime, so without a config file only the first load
+// builds a collector and later reloads return errReloadSkipped.
+func (r *reloadableCollector) reload() error {
+	r.mu.RLock()
+	loaded := r.collector != nil
+	r.mu.RUnlock()
+	if loaded && *configFile == "" {
+		return errReloadSkipped
+	}
+
+	err := r.load()
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
+
+// reloadHandler reloads the configuration on POST or PUT /-/reload.
+func (r *reloadableCollector) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.reload()
+	switch {
+	case errors.Is(err, errReloadSkipped):
+		log.Println("Not reloading configuration:", err)
+		fmt.Fprintln(w, err)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+	default:
+		log.Println("Reloaded configuration")
+		fmt.Fprintln(w, "configuration reloaded")
+	}
+}
+
+func (r *reloadableCollector) load() error {
+	if *configFile == "" {
+		if err := validateSourceType(*nginxSourceType); err != nil {
+			return err
+		}
+		if *nginxScrapeURI == stdinURI && !*oneshot {
+			return errStdinWithoutOneshot
+		}
+		if *derivedMetrics && *nginxPollInterval == 0 {
+			return errDerivedWithoutPolling
+		}
+		if *derivedMetrics && *nginxSourceType != sourceVts {
+			return errDerivedWithoutVts
+		}
+		auth := flagAuthConfig()
+		if err := auth.validate(); err != nil {
+			return err
+		}
+		zoneFilters, err := newZoneFilters(flagZonesConfig())
+		if err != nil {
+			return err
+		}
+		exporter, err := newFlagExporter(*nginxScrapeURI, *metricsNamespace, zoneFilters)
+		if err != nil {
+			return err
+		}
+		// probes do not get the credentials of -nginx.scrape_uri
+		headers := nginxHeaders.headers()
+		host, err := splitHost(&headers)
+		if err != nil {
+			return err
+		}
+		if err := headers.Validate(); err != nil {
+			return err
+		}
+		exporter.Host = host
+		exporter.Transport = config.NewHeadersRoundTripper(&headers, auth.roundTripper(exporter.Transport))
+		exporter.CacheTTL = *nginxCacheTTL
+		exporter.PollInterval = *nginxPollInterval
+		exporter.DerivedMetrics = *derivedMetrics
+		r.swap(exporter, *metricsNamespace, zoneFilters)
+		return nil
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	zoneFilters, err := newZoneFilters(cfg.Zones)
+	if err != nil {
+		return err
+	}
+	targets, err := newTargetsCollector(cfg, zoneFilters)
+	if err != nil {
+		return err
+	}
+	r.swap(targets, cfg.Namespace, zoneFilters)
+	return nil
+}
+
+// swap installs collector along with the configuration probes use, moving
+// background polling over from the previous collector.
+func (r *reloadableCollector) swap(collector prometheus.Collector, namespace string, zoneFilters map[string]*zoneFilter) {
+	r.swapMu.Lock()
+	defer r.swapMu.Unlock()
+
+	if p, ok := collector.(poller); ok && r.polling {
+		p.startPolling()
+	}
+
+	r.mu.Lock()
+	old := r.collector
+	r.collector = collector
+	r.namespace = namespace
+	r.zoneFilters = zoneFilters
+	r.mu.Unlock()
+
+	if p, ok := old.(poller); ok {
+		p.stopPolling()
+	}
+}
+
+// startPolling starts the background polls of the current and future
+// collectors. Until then, collections scrape nginx directly.
+func (r *reloadableCollector) startPolling() {
+	r.swapMu.Lock()
+	defer r.swapMu.Unlock()
+
+	r.polling = true
+	r.mu.RLock()
+	collector := r.collector
+	r.mu.RUnlock()
+	if p, ok := collector.(poller); ok {
+		p.startPolling()
+	}
+}
+
+// Namespace returns the metrics namespace of the current configuration.
+func (r *reloadableCollector) Namespace() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.namespace
+}
+
+// NewExporter returns an exporter for uri using the current configuration.
+func (r *reloadableCollector) NewExporter(uri string) (*Exporter, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return newFlagExporter(uri, r.namespace, r.zoneFilters)
+}
+
+// newFlagExporter returns an exporter for uri configured by the flags.
+func newFlagExporter(uri, namespace string, zoneFilters map[string]*zoneFilter) (*Exporter, error) {
+	tlsConfig, err := flagTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(uri, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter := NewExporter(namespace, uri, nil)
+	exporter.SourceType = *nginxSourceType
+	exporter.Transport = transport
+	exporter.ZoneFilters = zoneFilters
+	return exporter, nil
+}
+
+func (r *reloadableCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (r *reloadableCollector) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	collector := r.collector
+	r.mu.RUnlock()
+
+	collector.Collect(ch)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func reloadSuccessValue(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := configReloadSuccess.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func (r *reloadableCollector) current() any {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.collector
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	nginx := newTestNginx(t, `{"serverZones": {"a": {}}}`)
+	setVar(t, configFile, "")
+	setVar(t, nginxScrapeURI, nginx.URL)
+
+	r := &reloadableCollector{}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := r.current()
+	if loaded == nil {
+		t.Fatal("first load did not build a collector from the flags")
+	}
+	if !hasSample(scrapeLines(t, r), `nginx_server_requests{code="total",host="a"}`) {
+		t.Error("flag configuration not served")
+	}
+
+	// the flags cannot have changed, so the reload is skipped
+	configReloadSuccess.Set(0)
+	if err := r.reload(); !errors.Is(err, errReloadSkipped) {
+		t.Fatalf("reload() error = %v, want %v", err, errReloadSkipped)
+	}
+	if r.current() != loaded {
+		t.Error("reload without a config file swapped the collector")
+	}
+	if got := reloadSuccessValue(t); got != 0 {
+		t.Errorf("skipped reload set config_last_reload_successful to %v", got)
+	}
+}
+
+func TestLoadDerivedFlags(t *testing.T) {
+	tests := []struct {
+		sourceType   string
+		pollInterval time.Duration
+		wantErr      error
+	}{
+		{sourceType: sourceVts, pollInterval: time.Hour},
+		{sourceType: sourceVts, wantErr: errDerivedWithoutPolling},
+		{sourceType: sourceStubStatus, pollInterval: time.Hour, wantErr: errDerivedWithoutVts},
+		{sourceType: sourcePrometheus, pollInterval: time.Hour, wantErr: errDerivedWithoutVts},
+	}
+
+	nginx := newTestNginx(t, `{"serverZones": {"a": {}}}`)
+	setVar(t, configFile, "")
+	setVar(t, nginxScrapeURI, nginx.URL)
+	setVar(t, derivedMetrics, true)
+	for _, tt := range tests {
+		setVar(t, nginxSourceType, tt.sourceType)
+		setVar(t, nginxPollInterval, tt.pollInterval)
+		r := &reloadableCollector{}
+		if err := r.load(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s, poll interval %v: load() error = %v, want %v", tt.sourceType, tt.pollInterval, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	first := newTestNginx(t, `{"serverZones": {"first": {}}}`)
+	second := newTestNginx(t, `{"serverZones": {"second": {}}}`)
+	path := writeConfig(t, "targets:\n  - url: "+first.URL+"\n")
+	setVar(t, configFile, path)
+
+	r := &reloadableCollector{}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := scrapeLines(t, r); !hasSample(lines, `nginx_server_requests{code="total",host="first"`) {
+		t.Errorf("first config not served:\n%s", strings.Join(lines, "\n"))
+	}
+
+	if err := os.WriteFile(path, []byte("targets:\n  - url: "+second.URL+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	lines := scrapeLines(t, r)
+	if !hasSample(lines, `nginx_server_requests{code="total",host="second"`) || hasSample(lines, `nginx_server_requests{code="total",host="first"`) {
+		t.Errorf("reloaded config not served:\n%s", strings.Join(lines, "\n"))
+	}
+	if got := reloadSuccessValue(t); got != 1 {
+		t.Errorf("config_last_reload_successful = %v, want 1", got)
+	}
+
+	// an invalid config keeps the previous one
+	if err := os.WriteFile(path, []byte("targets: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("reload of an invalid config succeeded")
+	}
+	if got := reloadSuccessValue(t); got != 0 {
+		t.Errorf("config_last_reload_successful = %v, want 0", got)
+	}
+	if lines := scrapeLines(t, r); !hasSample(lines, `nginx_server_requests{code="total",host="second"`) {
+		t.Errorf("previous config not kept:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestReloadableCollectorSwapPolling(t *testing.T) {
+	oldNginx := newTestNginx(t, `{"serverZones": {"old": {}}}`)
+	newNginx := newTestNginx(t, `{"serverZones": {"new": {}}}`)
+	oldExporter := NewExporter("nginx", oldNginx.URL, nil)
+	oldExporter.PollInterval = 5 * time.Millisecond
+	newExporter := NewExporter("nginx", newNginx.URL, nil)
+	newExporter.PollInterval = 5 * time.Millisecond
+	defer newExporter.stopPolling()
+
+	r := &reloadableCollector{}
+	r.swap(oldExporter, "nginx", nil)
+	if oldExporter.polling() {
+		t.Fatal("collector polls before startPolling")
+	}
+	r.startPolling()
+	if !oldExporter.polling() || oldNginx.requests.Load() == 0 {
+		t.Fatal("startPolling did not poll the current collector")
+	}
+
+	r.swap(newExporter, "nginx", nil)
+	// the new collector is polled before it is served
+	if newNginx.requests.Load() == 0 {
+		t.Error("new collector not polled before the swap")
+	}
+	lines := scrapeLines(t, r)
+	if !hasSample(lines, `nginx_server_requests{code="total",host="new"}`) || hasSample(lines, `host="old"`) {
+		t.Errorf("swapped collector not served:\n%s", strings.Join(lines, "\n"))
+	}
+
+	// a poll of the old collector may still be running when it is stopped
+	time.Sleep(20 * time.Millisecond)
+	oldRequests, newRequests := oldNginx.requests.Load(), newNginx.requests.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := oldNginx.requests.Load(); n != oldRequests {
+		t.Errorf("old collector polled %d times after the swap", n-oldRequests)
+	}
+	if newNginx.requests.Load() == newRequests {
+		t.Error("new collector does not poll in the background")
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	nginx := newTestNginx(t, `{}`)
+	setVar(t, nginxScrapeURI, nginx.URL)
+
+	tests := []struct {
+		name       string
+		configFile string
+		method     string
+		wantCode   int
+		wantBody   string
+	}{
+		{name: "method", method: http.MethodGet, wantCode: http.StatusMethodNotAllowed},
+		{name: "skipped", method: http.MethodPost, wantCode: http.StatusOK, wantBody: errReloadSkipped.Error()},
+		{name: "reloaded", configFile: writeConfig(t, "targets:\n  - url: "+nginx.URL+"\n"), method: http.MethodPut, wantCode: http.StatusOK, wantBody: "configuration reloaded"},
+		{name: "failed", configFile: writeConfig(t, "targets: []\n"), method: http.MethodPost, wantCode: http.StatusInternalServerError, wantBody: "no targets configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, configFile, "")
+			r := &reloadableCollector{}
+			if err := r.reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			setVar(t, configFile, tt.configFile)
+			w := httptest.NewRecorder()
+			r.reloadHandler(w, httptest.NewRequest(tt.method, "/-/reload", nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReloadStaticLabelClash(t *testing.T) {
+	nginx := newTestNginx(t, `{"serverZones": {"a": {}}}`)
+	setVar(t, configFile, writeConfig(t, "targets:\n  - url: "+nginx.URL+"\n"))
+	r := &reloadableCollector{}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	setVar(t, configFile, writeConfig(t, "targets:\n  - url: "+nginx.URL+"\n    labels:\n      host: edge\n"))
+	if err := r.reload(); err == nil {
+		t.Fatal("reload with a static host label succeeded")
+	}
+	// collecting must not panic
+	if !hasSample(scrapeLines(t, r), `nginx_server_requests{code="total",host="a",target=`) {
+		t.Error("previous configuration not served")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeResult is the outcome of a scrape. With CacheTTL set it holds the
+// scraped metrics, which are served again until the TTL expires.
+type scrapeResult struct {
+	metrics  []prometheus.Metric
+	err      error
+	time     time.Time
+	duration time.Duration
+}
+
+// scrapeTo scrapes nginx vts, sending its metrics to ch.
+func (e *Exporter) scrapeTo(ch chan<- prometheus.Metric) *scrapeResult {
+	start := time.Now()
+	stage, err := e.scrape(ch)
+	if err != nil {
+		log.Println(stage, "failed", err)
+		e.scrapeErrors.WithLabelValues(stage).Inc()
+	}
+	return &scrapeResult{err: err, time: start, duration: time.Since(start)}
+}
+
+// cachedScrape returns the last scrape if it is younger than CacheTTL, and
+// scrapes again otherwise. Concurrent collections share a single scrape.
+func (e *Exporter) cachedScrape() *scrapeResult {
+	e.cacheMu.Lock()
+	cached := e.cached
+	e.cacheMu.Unlock()
+	if cached != nil && time.Since(cached.time) < e.CacheTTL {
+		e.cacheHits.Inc()
+		return cached
+	}
+
+	scraped := false
+	v, _, _ := e.scrapeGroup.Do(e.URI, func() (interface{}, error) {
+		scraped = true
+		e.cacheMisses.Inc()
+
+		var result *scrapeResult
+		metrics := bufferMetrics(func(ch chan<- prometheus.Metric) {
+			result = e.scrapeTo(ch)
+		})
+		result.metrics = metrics
+
+		e.cacheMu.Lock()
+		e.cached = result
+		e.cacheMu.Unlock()
+		return result, nil
+	})
+	if !scraped {
+		e.cacheHits.Inc()
+	}
+	return v.(*scrapeResult)
+}
+
+// bufferMetrics returns the metrics that collect sends.
+func bufferMetrics(collect func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+	collect(ch)
+	close(ch)
+	return <-done
+}
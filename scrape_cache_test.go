@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ageCache makes the cached scrape of e older by d.
+func ageCache(e *Exporter, d time.Duration) {
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+	e.cached.time = e.cached.time.Add(-d)
+}
+
+func TestCachedScrapeTTL(t *testing.T) {
+	nginx := newTestNginx(t, `{"serverZones": {"a": {"requestCounter": 3}}}`)
+	e := NewExporter("nginx", nginx.URL, nil)
+	e.CacheTTL = time.Minute
+
+	tests := []struct {
+		name                 string
+		age                  time.Duration
+		wantRequests         int64
+		wantHits, wantMisses string
+	}{
+		{name: "first collection", wantRequests: 1, wantHits: "0", wantMisses: "1"},
+		{name: "within the TTL", wantRequests: 1, wantHits: "1", wantMisses: "1"},
+		{name: "just within the TTL", age: 59 * time.Second, wantRequests: 1, wantHits: "2", wantMisses: "1"},
+		{name: "after the TTL", age: 2 * time.Second, wantRequests: 2, wantHits: "2", wantMisses: "2"},
+		{name: "within the TTL again", wantRequests: 2, wantHits: "3", wantMisses: "2"},
+	}
+
+	for _, tt := range tests {
+		if tt.age > 0 {
+			ageCache(e, tt.age)
+		}
+		lines := scrapeLines(t, e)
+		if n := nginx.requests.Load(); n != tt.wantRequests {
+			t.Errorf("%s: nginx was requested %d times, want %d", tt.name, n, tt.wantRequests)
+		}
+		if got, _ := sampleValue(lines, "nginx_exporter_cache_hits_total"); got != tt.wantHits {
+			t.Errorf("%s: cache_hits_total = %s, want %s", tt.name, got, tt.wantHits)
+		}
+		if got, _ := sampleValue(lines, "nginx_exporter_cache_misses_total"); got != tt.wantMisses {
+			t.Errorf("%s: cache_misses_total = %s, want %s", tt.name, got, tt.wantMisses)
+		}
+		// cached metrics are served on hits as well as misses
+		if !hasSample(lines, `nginx_server_requests{code="total",host="a"} 3`) {
+			t.Errorf("%s: missing cached metrics in\n%s", tt.name, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestCachedScrapeAge(t *testing.T) {
+	nginx := newTestNginx(t, `{}`)
+	e := NewExporter("nginx", nginx.URL, nil)
+	e.CacheTTL = time.Minute
+
+	scrapeLines(t, e)
+	ageCache(e, 10*time.Second)
+	lines := scrapeLines(t, e)
+	value, ok := sampleValue(lines, "nginx_exporter_cache_age_seconds")
+	if !ok {
+		t.Fatalf("missing nginx_exporter_cache_age_seconds in\n%s", strings.Join(lines, "\n"))
+	}
+	if age, err := strconv.ParseFloat(value, 64); err != nil || age < 10 || age >= 60 {
+		t.Errorf("cache_age_seconds = %s, want between 10 and 60", value)
+	}
+
+	// without a cache the age is not exported
+	e = NewExporter("nginx", nginx.URL, nil)
+	if lines := scrapeLines(t, e); hasSample(lines, "nginx_exporter_cache_") {
+		t.Errorf("cache metrics without CacheTTL:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestCachedScrapeConcurrent(t *testing.T) {
+	var requests atomic.Int64
+	release := make(chan struct{})
+	nginx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer nginx.Close()
+	e := NewExporter("nginx", nginx.URL, nil)
+	e.CacheTTL = time.Minute
+
+	const collections = 5
+	var wg sync.WaitGroup
+	for i := 0; i < collections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.cachedScrape()
+		}()
+	}
+	// hold the fetch until the other collections are waiting on it
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("nginx was requested %d times by %d collections, want 1", n, collections)
+	}
+	lines := scrapeLines(t, e)
+	for _, want := range []string{
+		"nginx_exporter_cache_misses_total 1",
+		// the collections sharing the fetch and the one above
+		"nginx_exporter_cache_hits_total " + strconv.Itoa(collections),
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// status page formats, see -nginx.source_type
+const (
+	sourceVts        = "vts"
+	sourceStubStatus = "stub_status"
+	sourcePrometheus = "prometheus"
+)
+
+func validateSourceType(sourceType string) error {
+	switch sourceType {
+	case sourceVts, sourceStubStatus, sourcePrometheus:
+		return nil
+	}
+	return fmt.Errorf("invalid source type %q, must be %s, %s or %s", sourceType, sourceVts, sourceStubStatus, sourcePrometheus)
+}
+
+// parseStubStatus parses the plain text output of ngx_http_stub_status_module:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func parseStubStatus(data []byte) (Connections, error) {
+	var c Connections
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 16 ||
+		strings.Join(fields[0:2], " ") != "Active connections:" ||
+		strings.Join(fields[3:7], " ") != "server accepts handled requests" ||
+		fields[10] != "Reading:" || fields[12] != "Writing:" || fields[14] != "Waiting:" {
+		return c, fmt.Errorf("unexpected stub_status format")
+	}
+
+	for _, v := range []struct {
+		field int
+		value *uint64
+	}{
+		{2, &c.Active},
+		{7, &c.Accepted},
+		{8, &c.Handled},
+		{9, &c.Requests},
+		{11, &c.Reading},
+		{13, &c.Writing},
+		{15, &c.Waiting},
+	} {
+		n, err := strconv.ParseUint(fields[v.field], 10, 64)
+		if err != nil {
+			return c, fmt.Errorf("invalid stub_status value: %w", err)
+		}
+		*v.value = n
+	}
+
+	return c, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStubStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Connections
+		wantErr bool
+	}{
+		{
+			name: "nginx output",
+			data: "Active connections: 291 \nserver accepts handled requests\n 16630948 16630948 31070465 \nReading: 6 Writing: 179 Waiting: 106 \n",
+			want: Connections{Active: 291, Accepted: 16630948, Handled: 16630948, Requests: 31070465, Reading: 6, Writing: 179, Waiting: 106},
+		},
+		{
+			name: "CRLF and extra spaces",
+			data: "Active connections:  1\r\nserver accepts handled requests\r\n  2   3   4\r\nReading: 5  Writing: 6  Waiting: 7\r\n",
+			want: Connections{Active: 1, Accepted: 2, Handled: 3, Requests: 4, Reading: 5, Writing: 6, Waiting: 7},
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: true,
+		},
+		{
+			name:    "vts json",
+			data:    `{"hostName": "nginx-1", "connections": {"active": 1}}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing line",
+			data:    "Active connections: 291\nserver accepts handled requests\n 16630948 16630948 31070465\n",
+			wantErr: true,
+		},
+		{
+			name:    "renamed field",
+			data:    "Active connections: 291\nserver accepts handled requests\n 1 2 3\nReading: 6 Writing: 179 Idle: 106\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative value",
+			data:    "Active connections: -1\nserver accepts handled requests\n 1 2 3\nReading: 6 Writing: 179 Waiting: 106\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStubStatus([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStubStatus() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseStubStatus() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectStubStatus(t *testing.T) {
+	e := fixtureExporter(t, "Active connections: 291\nserver accepts handled requests\n 16630948 16630948 31070465\nReading: 6 Writing: 179 Waiting: 106\n")
+	e.SourceType = sourceStubStatus
+	lines := scrapeLines(t, e)
+
+	for _, want := range []string{
+		"nginx_up 1",
+		`nginx_server_connections{status="active"} 291`,
+		`nginx_server_connections{status="accepted"} 1.6630948e+07`,
+		`nginx_server_connections{status="requests"} 3.1070465e+07`,
+		`nginx_server_connections{status="waiting"} 106`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// zone kinds, used as the kind label of zone related exporter metrics
+const (
+	kindServer   = "server"
+	kindUpstream = "upstream"
+	kindFilter   = "filter"
+	kindCache    = "cache"
+	// kindStreamFilter is the kind of sts filter zones, which are as
+	// numerous as http filter zones. Other stream zones are few, one per
+	// listen or stream upstream.
+	kindStreamFilter = "stream_filter"
+)
+
+var zoneKinds = []string{kindServer, kindUpstream, kindFilter, kindCache, kindStreamFilter}
+
+// otherZone is the name of the zone aggregating the zones beyond the limit.
+const otherZone = "__other__"
+
+// zone limit actions
+const (
+	limitDrop = "drop"
+	limitFold = "fold"
+)
+
+// ZonesConfig selects the zones exported for each zone kind.
+type ZonesConfig struct {
+	Server   ZoneFilterConfig `yaml:"server"`
+	Upstream ZoneFilterConfig `yaml:"upstream"`
+	Filter   ZoneFilterConfig `yaml:"filter"`
+	Cache    ZoneFilterConfig `yaml:"cache"`
+	// StreamFilter selects the sts filter zones, matched like filter zones.
+	StreamFilter ZoneFilterConfig `yaml:"stream_filter"`
+	// LimitAction is either drop or fold.
+	LimitAction string `yaml:"limit_action"`
+}
+
+// ZoneFilterConfig holds regexes matched against zone names. They are
+// anchored on both ends, like Prometheus relabeling regexes. Filter zones
+// are matched as "<filter>::<filterName>".
+type ZoneFilterConfig struct {
+	Include string `yaml:"include"`
+	Exclude string `yaml:"exclude"`
+	// Limit is the maximum number of zones exported, unlimited if 0. Zones
+	// are taken in name order.
+	Limit int `yaml:"limit"`
+}
+
+func flagZonesConfig() ZonesConfig {
+	return ZonesConfig{
+		Server:       ZoneFilterConfig{Include: *serverZonesInclude, Exclude: *serverZonesExclude, Limit: *serverZonesLimit},
+		Upstream:     ZoneFilterConfig{Include: *upstreamZonesInclude, Exclude: *upstreamZonesExclude, Limit: *upstreamZonesLimit},
+		Filter:       ZoneFilterConfig{Include: *filterZonesInclude, Exclude: *filterZonesExclude, Limit: *filterZonesLimit},
+		Cache:        ZoneFilterConfig{Include: *cacheZonesInclude, Exclude: *cacheZonesExclude, Limit: *cacheZonesLimit},
+		StreamFilter: ZoneFilterConfig{Include: *streamFilterZonesInclude, Exclude: *streamFilterZonesExclude, Limit: *streamFilterZonesLimit},
+		LimitAction:  *zonesLimitAction,
+	}
+}
+
+type zoneFilter struct {
+	include, exclude *regexp.Regexp
+	limit            int
+	fold             bool
+}
+
+// newZoneFilters compiles the zone filters, keyed by zone kind.
+func newZoneFilters(cfg ZonesConfig) (map[string]*zoneFilter, error) {
+	if cfg.LimitAction != limitDrop && cfg.LimitAction != limitFold {
+		return nil, fmt.Errorf("invalid zones limit action %q, must be %s or %s", cfg.LimitAction, limitDrop, limitFold)
+	}
+
+	filters := map[string]*zoneFilter{}
+	for kind, c := range map[string]ZoneFilterConfig{
+		kindServer:       cfg.Server,
+		kindUpstream:     cfg.Upstream,
+		kindFilter:       cfg.Filter,
+		kindCache:        cfg.Cache,
+		kindStreamFilter: cfg.StreamFilter,
+	} {
+		if c.Limit < 0 {
+			return nil, fmt.Errorf("%s zones limit must not be negative", kind)
+		}
+
+		f := &zoneFilter{limit: c.Limit, fold: cfg.LimitAction == limitFold}
+		var err error
+		if f.include, err = compileAnchored(c.Include); err != nil {
+			return nil, fmt.Errorf("%s zones include: %w", kind, err)
+		}
+		if f.exclude, err = compileAnchored(c.Exclude); err != nil {
+			return nil, fmt.Errorf("%s zones exclude: %w", kind, err)
+		}
+		if f.include != nil || f.exclude != nil || f.limit > 0 {
+			filters[kind] = f
+		}
+	}
+	return filters, nil
+}
+
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func (f *zoneFilter) match(name string) bool {
+	if f == nil {
+		return true
+	}
+	if f.include != nil && !f.include.MatchString(name) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.MatchString(name)
+}
+
+// keepZone reports whether the zone passes the filters of its kind,
+// counting it as dropped otherwise.
+func (e *Exporter) keepZone(kind, name string) bool {
+	if e.ZoneFilters[kind].match(name) {
+		return true
+	}
+	e.droppedZones.WithLabelValues(kind).Inc()
+	return false
+}
+
+// selectZones returns the names of the zones of kind to export, and with
+// limit_action fold the names of the zones beyond the limit to aggregate.
+// names must be sorted. Dropped zones are counted if countDropped is set,
+// which it is not when the zones of a page are selected again.
+func (e *Exporter) selectZones(kind string, names []string, countDropped bool) (selected, other []string) {
+	f := e.ZoneFilters[kind]
+	dropped := 0
+	for _, name := range names {
+		if f.match(name) {
+			selected = append(selected, name)
+		} else {
+			dropped++
+		}
+	}
+
+	if f == nil || f.limit == 0 || len(selected) <= f.limit {
+		e.cardinalityLimited.WithLabelValues(kind).Set(0)
+	} else {
+		e.cardinalityLimited.WithLabelValues(kind).Set(1)
+		if f.fold {
+			other = selected[f.limit:]
+		} else {
+			dropped += len(selected) - f.limit
+		}
+		selected = selected[:f.limit]
+	}
+
+	if countDropped && dropped > 0 {
+		e.droppedZones.WithLabelValues(kind).Add(float64(dropped))
+	}
+	return selected, other
+}
+
+// filterZoneNames returns the filter and name of each filter zone, keyed by
+// the "<filter>::<filterName>" name the zone filters match.
+func filterZoneNames[V any](zones map[string]map[string]V) map[string][2]string {
+	names := map[string][2]string{}
+	for filter, values := range zones {
+		for name := range values {
+			names[filter+"::"+name] = [2]string{filter, name}
+		}
+	}
+	return names
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// merge adds the counters of o to s, corrected for overflow, to aggregate
+// zones beyond the limit.
+// Averages are weighted by request count.
+func (s *Server) merge(o Server) {
+	s.RequestMsec = weightedAverage(s.RequestMsec, s.RequestCounter, o.RequestMsec, o.RequestCounter)
+	m := max(s.OverCounts.MaxIntegerSize, o.OverCounts.MaxIntegerSize)
+	addCounter(&s.RequestCounter, &s.OverCounts.RequestCounter, o.RequestCounter, o.OverCounts.RequestCounter, m)
+	addCounter(&s.InBytes, &s.OverCounts.InBytes, o.InBytes, o.OverCounts.InBytes, m)
+	addCounter(&s.OutBytes, &s.OverCounts.OutBytes, o.OutBytes, o.OverCounts.OutBytes, m)
+	addCounter(&s.RequestMsecCounter, &s.OverCounts.RequestMsecCounter, o.RequestMsecCounter, o.OverCounts.RequestMsecCounter, m)
+	s.RequestBuckets.merge(o.RequestBuckets)
+
+	addCounter(&s.Responses.OneXx, &s.OverCounts.OneXx, o.Responses.OneXx, o.OverCounts.OneXx, m)
+	addCounter(&s.Responses.TwoXx, &s.OverCounts.TwoXx, o.Responses.TwoXx, o.OverCounts.TwoXx, m)
+	addCounter(&s.Responses.ThreeXx, &s.OverCounts.ThreeXx, o.Responses.ThreeXx, o.OverCounts.ThreeXx, m)
+	addCounter(&s.Responses.FourXx, &s.OverCounts.FourXx, o.Responses.FourXx, o.OverCounts.FourXx, m)
+	addCounter(&s.Responses.FiveXx, &s.OverCounts.FiveXx, o.Responses.FiveXx, o.OverCounts.FiveXx, m)
+	addCounter(&s.Responses.Miss, &s.OverCounts.Miss, o.Responses.Miss, o.OverCounts.Miss, m)
+	addCounter(&s.Responses.Bypass, &s.OverCounts.Bypass, o.Responses.Bypass, o.OverCounts.Bypass, m)
+	addCounter(&s.Responses.Expired, &s.OverCounts.Expired, o.Responses.Expired, o.OverCounts.Expired, m)
+	addCounter(&s.Responses.Stale, &s.OverCounts.Stale, o.Responses.Stale, o.OverCounts.Stale, m)
+	addCounter(&s.Responses.Updating, &s.OverCounts.Updating, o.Responses.Updating, o.OverCounts.Updating, m)
+	addCounter(&s.Responses.Revalidated, &s.OverCounts.Revalidated, o.Responses.Revalidated, o.OverCounts.Revalidated, m)
+	addCounter(&s.Responses.Hit, &s.OverCounts.Hit, o.Responses.Hit, o.OverCounts.Hit, m)
+	addCounter(&s.Responses.Scarce, &s.OverCounts.Scarce, o.Responses.Scarce, o.OverCounts.Scarce, m)
+	s.OverCounts.MaxIntegerSize = m
+}
+
+// merge adds the counters of o to s, corrected for overflow, to aggregate
+// zones beyond the limit.
+// Averages are weighted by request count.
+func (s *Upstream) merge(o Upstream) {
+	s.ResponseMsec = weightedAverage(s.ResponseMsec, s.RequestCounter, o.ResponseMsec, o.RequestCounter)
+	s.RequestMsec = weightedAverage(s.RequestMsec, s.RequestCounter, o.RequestMsec, o.RequestCounter)
+	m := max(s.OverCounts.MaxIntegerSize, o.OverCounts.MaxIntegerSize)
+	addCounter(&s.RequestCounter, &s.OverCounts.RequestCounter, o.RequestCounter, o.OverCounts.RequestCounter, m)
+	addCounter(&s.InBytes, &s.OverCounts.InBytes, o.InBytes, o.OverCounts.InBytes, m)
+	addCounter(&s.OutBytes, &s.OverCounts.OutBytes, o.OutBytes, o.OverCounts.OutBytes, m)
+	addCounter(&s.RequestMsecCounter, &s.OverCounts.RequestMsecCounter, o.RequestMsecCounter, o.OverCounts.RequestMsecCounter, m)
+	s.RequestBuckets.merge(o.RequestBuckets)
+
+	addCounter(&s.Responses.OneXx, &s.OverCounts.OneXx, o.Responses.OneXx, o.OverCounts.OneXx, m)
+	addCounter(&s.Responses.TwoXx, &s.OverCounts.TwoXx, o.Responses.TwoXx, o.OverCounts.TwoXx, m)
+	addCounter(&s.Responses.ThreeXx, &s.OverCounts.ThreeXx, o.Responses.ThreeXx, o.OverCounts.ThreeXx, m)
+	addCounter(&s.Responses.FourXx, &s.OverCounts.FourXx, o.Responses.FourXx, o.OverCounts.FourXx, m)
+	addCounter(&s.Responses.FiveXx, &s.OverCounts.FiveXx, o.Responses.FiveXx, o.OverCounts.FiveXx, m)
+	s.OverCounts.MaxIntegerSize = m
+}
+
+// merge adds the counters of o to s, corrected for overflow, to aggregate
+// zones beyond the limit.
+// Averages are weighted by session count.
+func (s *StreamUpstream) merge(o StreamUpstream) {
+	s.SessionMsec = weightedAverage(s.SessionMsec, s.ConnectCounter, o.SessionMsec, o.ConnectCounter)
+	m := max(s.OverCounts.MaxIntegerSize, o.OverCounts.MaxIntegerSize)
+	addCounter(&s.ConnectCounter, &s.OverCounts.ConnectCounter, o.ConnectCounter, o.OverCounts.ConnectCounter, m)
+	addCounter(&s.InBytes, &s.OverCounts.InBytes, o.InBytes, o.OverCounts.InBytes, m)
+	addCounter(&s.OutBytes, &s.OverCounts.OutBytes, o.OutBytes, o.OverCounts.OutBytes, m)
+	addCounter(&s.SessionMsecCounter, &s.OverCounts.SessionMsecCounter, o.SessionMsecCounter, o.OverCounts.SessionMsecCounter, m)
+	s.SessionBuckets.merge(o.SessionBuckets)
+
+	addCounter(&s.Responses.OneXx, &s.OverCounts.OneXx, o.Responses.OneXx, o.OverCounts.OneXx, m)
+	addCounter(&s.Responses.TwoXx, &s.OverCounts.TwoXx, o.Responses.TwoXx, o.OverCounts.TwoXx, m)
+	addCounter(&s.Responses.ThreeXx, &s.OverCounts.ThreeXx, o.Responses.ThreeXx, o.OverCounts.ThreeXx, m)
+	addCounter(&s.Responses.FourXx, &s.OverCounts.FourXx, o.Responses.FourXx, o.OverCounts.FourXx, m)
+	addCounter(&s.Responses.FiveXx, &s.OverCounts.FiveXx, o.Responses.FiveXx, o.OverCounts.FiveXx, m)
+	s.OverCounts.MaxIntegerSize = m
+}
+
+// merge adds the counters, corrected for overflow, and sizes of o to s, to
+// aggregate zones beyond the limit.
+func (s *Cache) merge(o Cache) {
+	s.MaxSize += o.MaxSize
+	s.UsedSize += o.UsedSize
+	m := max(s.OverCounts.MaxIntegerSize, o.OverCounts.MaxIntegerSize)
+	addCounter(&s.InBytes, &s.OverCounts.InBytes, o.InBytes, o.OverCounts.InBytes, m)
+	addCounter(&s.OutBytes, &s.OverCounts.OutBytes, o.OutBytes, o.OverCounts.OutBytes, m)
+
+	addCounter(&s.Responses.Miss, &s.OverCounts.Miss, o.Responses.Miss, o.OverCounts.Miss, m)
+	addCounter(&s.Responses.Bypass, &s.OverCounts.Bypass, o.Responses.Bypass, o.OverCounts.Bypass, m)
+	addCounter(&s.Responses.Expired, &s.OverCounts.Expired, o.Responses.Expired, o.OverCounts.Expired, m)
+	addCounter(&s.Responses.Stale, &s.OverCounts.Stale, o.Responses.Stale, o.OverCounts.Stale, m)
+	addCounter(&s.Responses.Updating, &s.OverCounts.Updating, o.Responses.Updating, o.OverCounts.Updating, m)
+	addCounter(&s.Responses.Revalidated, &s.OverCounts.Revalidated, o.Responses.Revalidated, o.OverCounts.Revalidated, m)
+	addCounter(&s.Responses.Hit, &s.OverCounts.Hit, o.Responses.Hit, o.OverCounts.Hit, m)
+	addCounter(&s.Responses.Scarce, &s.OverCounts.Scarce, o.Responses.Scarce, o.OverCounts.Scarce, m)
+	s.OverCounts.MaxIntegerSize = m
+}
+
+// merge adds the counters of o to b. Histograms with different bucket
+// bounds cannot be aggregated, so b is emptied on mismatch.
+func (b *Buckets) merge(o Buckets) {
+	if !slices.Equal(b.Msecs, o.Msecs) || len(b.Counters) != len(o.Counters) {
+		*b = Buckets{}
+		return
+	}
+
+	// b may share its counters with the zone it was copied from
+	counters := make([]uint64, len(b.Counters))
+	for i := range counters {
+		counters[i] = b.Counters[i] + o.Counters[i]
+	}
+	b.Counters = counters
+}
+
+func weightedAverage(a, aWeight, b, bWeight uint64) uint64 {
+	if aWeight+bWeight == 0 {
+		return 0
+	}
+	return uint64((float64(a)*float64(aWeight) + float64(b)*float64(bWeight)) / float64(aWeight+bWeight))
+}
+
+// addCounter adds the counter v, wrapped vOver times, to the counter value,
+// wrapped *over times. The sum of the totals corrected by counterValue is
+// stored back as a value and an overCount, as adding the raw values would
+// wrap past 2^64 without counting it.
+func addCounter(value, over *uint64, v, vOver uint64, maxIntegerSize float64) {
+	if maxIntegerSize <= 0 {
+		*value += v
+		*over += vOver
+		return
+	}
+	total := counterValue(*value, *over, maxIntegerSize) + counterValue(v, vOver, maxIntegerSize)
+	wraps := math.Floor(total / maxIntegerSize)
+	rest := math.Max(total-wraps*maxIntegerSize, 0)
+	if rest >= maxIntegerSize {
+		wraps, rest = wraps+1, 0
+	}
+	*value, *over = uint64(rest), uint64(wraps)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewZoneFiltersErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ZonesConfig
+	}{
+		{name: "limit action", cfg: ZonesConfig{LimitAction: "truncate"}},
+		{name: "negative limit", cfg: ZonesConfig{LimitAction: limitDrop, Server: ZoneFilterConfig{Limit: -1}}},
+		{name: "include", cfg: ZonesConfig{LimitAction: limitDrop, Upstream: ZoneFilterConfig{Include: "("}}},
+		{name: "exclude", cfg: ZonesConfig{LimitAction: limitDrop, Cache: ZoneFilterConfig{Exclude: "[a-"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newZoneFilters(tt.cfg); err == nil {
+				t.Error("newZoneFilters() succeeded")
+			}
+		})
+	}
+}
+
+func TestZoneFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    ZoneFilterConfig
+		zone   string
+		wanted bool
+	}{
+		{name: "no filter", zone: "example.com", wanted: true},
+		{name: "include", cfg: ZoneFilterConfig{Include: `.*\.example\.com`}, zone: "www.example.com", wanted: true},
+		{name: "include anchored at start", cfg: ZoneFilterConfig{Include: `example\.com`}, zone: "www.example.com", wanted: false},
+		{name: "include anchored at end", cfg: ZoneFilterConfig{Include: `www\.example`}, zone: "www.example.com", wanted: false},
+		{name: "include alternation anchored", cfg: ZoneFilterConfig{Include: `a|b`}, zone: "ab", wanted: false},
+		{name: "exclude", cfg: ZoneFilterConfig{Exclude: `\*`}, zone: "*", wanted: false},
+		{name: "exclude wins", cfg: ZoneFilterConfig{Include: `.*`, Exclude: `_`}, zone: "_", wanted: false},
+		{name: "exclude other", cfg: ZoneFilterConfig{Exclude: `\*`}, zone: "example.com", wanted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters, err := newZoneFilters(ZonesConfig{LimitAction: limitDrop, Server: tt.cfg})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filters[kindServer].match(tt.zone); got != tt.wanted {
+				t.Errorf("match(%q) = %t, want %t", tt.zone, got, tt.wanted)
+			}
+		})
+	}
+}
+
+func TestCollectZoneFilters(t *testing.T) {
+	const status = `{
+		"serverZones": {"a.example.com": {}, "b.example.com": {}, "*": {}},
+		"upstreamZones": {"backend": [{"server": "10.0.0.1:80"}], "::nogroups": [{"server": "10.0.0.2:80"}]},
+		"filterZones": {"country": {"US": {}, "DE": {}}, "status": {"200": {}}},
+		"cacheZones": {"static": {}},
+		"streamFilterZones": {"port": {"1981": {}, "53": {}}}
+	}`
+	filters, err := newZoneFilters(ZonesConfig{
+		LimitAction:  limitDrop,
+		Server:       ZoneFilterConfig{Include: `.*\.example\.com`, Exclude: `b\..*`},
+		Upstream:     ZoneFilterConfig{Exclude: `::nogroups`},
+		Filter:       ZoneFilterConfig{Include: `country::.*`},
+		Cache:        ZoneFilterConfig{Exclude: `.*`},
+		StreamFilter: ZoneFilterConfig{Exclude: `port::53`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fixtureExporter(t, status)
+	e.ZoneFilters = filters
+	lines := scrapeLines(t, e)
+
+	for _, want := range []string{
+		`nginx_server_requests{code="total",host="a.example.com"}`,
+		`nginx_upstream_requests{backend="10.0.0.1:80",code="total",upstream="backend"}`,
+		`nginx_filter_requests{code="total",filter="country",filterName="DE"}`,
+		`nginx_filter_requests{code="total",filter="country",filterName="US"}`,
+		`nginx_exporter_dropped_zones_total{kind="server"} 2`,
+		`nginx_exporter_dropped_zones_total{kind="upstream"} 1`,
+		`nginx_exporter_dropped_zones_total{kind="filter"} 1`,
+		`nginx_exporter_dropped_zones_total{kind="cache"} 1`,
+		`nginx_stream_filter_connects{code="total",filter="port",filterName="1981"}`,
+		`nginx_exporter_dropped_zones_total{kind="stream_filter"} 1`,
+	} {
+		if !hasSample(lines, want) {
+			t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+	for _, absent := range []string{
+		`nginx_server_requests{code="total",host="b.example.com"}`,
+		`nginx_server_requests{code="total",host="*"}`,
+		`nginx_upstream_requests{backend="10.0.0.2:80"`,
+		`nginx_filter_requests{code="total",filter="status"`,
+		`nginx_cache_`,
+		`nginx_stream_filter_connects{code="total",filter="port",filterName="53"}`,
+	} {
+		if hasSample(lines, absent) {
+			t.Errorf("unexpected %s", absent)
+		}
+	}
+}
+
+// TestDroppedZonesCountsZones shows that dropped_zones_total counts zones:
+// an upstream zone with several backends, each exported as many series, is
+// counted once.
+func TestDroppedZonesCountsZones(t *testing.T) {
+	const status = `{"upstreamZones": {"backend": [{"server": "10.0.0.1:80"}, {"server": "10.0.0.2:80"}, {"server": "10.0.0.3:80"}]}}`
+	var series int
+	for _, line := range scrapeLines(t, fixtureExporter(t, status)) {
+		if strings.Contains(line, `upstream="backend"`) {
+			series++
+		}
+	}
+	if series <= 3 {
+		t.Fatalf("upstream zone exported as %d series, want more than one per backend", series)
+	}
+
+	filters, err := newZoneFilters(ZonesConfig{LimitAction: limitDrop, Upstream: ZoneFilterConfig{Exclude: "backend"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fixtureExporter(t, status)
+	e.ZoneFilters = filters
+	lines := scrapeLines(t, e)
+	if want := `nginx_exporter_dropped_zones_total{kind="upstream"} 1`; !slices.Contains(lines, want) {
+		t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+	}
+}
+
+func TestServerMerge(t *testing.T) {
+	var s, o Server
+	s.RequestCounter, s.RequestMsec, s.InBytes, s.Responses.FiveXx = 10, 100, 1000, 1
+	s.OverCounts.MaxIntegerSize, s.OverCounts.RequestCounter = 4294967295, 1
+	s.RequestBuckets = Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{6, 4}}
+	o.RequestCounter, o.RequestMsec, o.InBytes, o.Responses.FiveXx = 30, 200, 3000, 2
+	o.OverCounts.MaxIntegerSize, o.OverCounts.RequestCounter, o.OverCounts.FiveXx = 4294967295, 2, 1
+	o.RequestBuckets = Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{10, 20}}
+	shared := s.RequestBuckets.Counters
+
+	s.merge(o)
+
+	if s.RequestCounter != 40 || s.InBytes != 4000 || s.Responses.FiveXx != 3 {
+		t.Errorf("counters = %d, %d, %d, want 40, 4000, 3", s.RequestCounter, s.InBytes, s.Responses.FiveXx)
+	}
+	if s.OverCounts.RequestCounter != 3 || s.OverCounts.FiveXx != 1 {
+		t.Errorf("overCounts = %d, %d, want 3, 1", s.OverCounts.RequestCounter, s.OverCounts.FiveXx)
+	}
+	if s.OverCounts.MaxIntegerSize != 4294967295 {
+		t.Errorf("maxIntegerSize = %v, want 4294967295", s.OverCounts.MaxIntegerSize)
+	}
+	// (10*100 + 30*200) / 40
+	if s.RequestMsec != 175 {
+		t.Errorf("requestMsec = %d, want 175", s.RequestMsec)
+	}
+	if want := []uint64{16, 24}; !reflect.DeepEqual(s.RequestBuckets.Counters, want) {
+		t.Errorf("bucket counters = %v, want %v", s.RequestBuckets.Counters, want)
+	}
+	if want := []uint64{6, 4}; !reflect.DeepEqual(shared, want) {
+		t.Errorf("merge modified the counters of the merged zone: %v", shared)
+	}
+}
+
+func TestUpstreamMerge(t *testing.T) {
+	var s, o Upstream
+	s.RequestCounter, s.ResponseMsec, s.OutBytes = 1, 10, 5
+	s.OverCounts.OutBytes = 1
+	o.RequestCounter, o.ResponseMsec, o.OutBytes = 3, 50, 7
+	o.OverCounts.OutBytes, o.OverCounts.RequestMsecCounter = 2, 1
+
+	s.merge(o)
+
+	if s.RequestCounter != 4 || s.OutBytes != 12 || s.ResponseMsec != 40 {
+		t.Errorf("merged = %d, %d, %d, want 4, 12, 40", s.RequestCounter, s.OutBytes, s.ResponseMsec)
+	}
+	if s.OverCounts.OutBytes != 3 || s.OverCounts.RequestMsecCounter != 1 {
+		t.Errorf("overCounts = %d, %d, want 3, 1", s.OverCounts.OutBytes, s.OverCounts.RequestMsecCounter)
+	}
+}
+
+func TestCacheMerge(t *testing.T) {
+	var s, o Cache
+	s.MaxSize, s.UsedSize, s.Responses.Hit, s.OverCounts.Hit = 100, 10, 5, 1
+	o.MaxSize, o.UsedSize, o.Responses.Hit, o.OverCounts.Hit = 200, 20, 7, 2
+
+	s.merge(o)
+
+	if s.MaxSize != 300 || s.UsedSize != 30 || s.Responses.Hit != 12 || s.OverCounts.Hit != 3 {
+		t.Errorf("merged = %d, %d, %d, %d, want 300, 30, 12, 3", s.MaxSize, s.UsedSize, s.Responses.Hit, s.OverCounts.Hit)
+	}
+}
+
+func TestStreamUpstreamMerge(t *testing.T) {
+	var s, o StreamUpstream
+	s.ConnectCounter, s.SessionMsec, s.InBytes, s.Responses.FiveXx = 1, 10, 5, 1
+	s.SessionBuckets = Buckets{Msecs: []uint64{100}, Counters: []uint64{1}}
+	o.ConnectCounter, o.SessionMsec, o.InBytes, o.Responses.FiveXx = 3, 50, 7, 2
+	o.OverCounts.ConnectCounter, o.OverCounts.SessionMsecCounter = 2, 1
+	o.SessionBuckets = Buckets{Msecs: []uint64{100}, Counters: []uint64{3}}
+
+	s.merge(o)
+
+	if s.ConnectCounter != 4 || s.InBytes != 12 || s.Responses.FiveXx != 3 || s.SessionMsec != 40 {
+		t.Errorf("merged = %d, %d, %d, %d, want 4, 12, 3, 40", s.ConnectCounter, s.InBytes, s.Responses.FiveXx, s.SessionMsec)
+	}
+	if s.OverCounts.ConnectCounter != 2 || s.OverCounts.SessionMsecCounter != 1 {
+		t.Errorf("overCounts = %d, %d, want 2, 1", s.OverCounts.ConnectCounter, s.OverCounts.SessionMsecCounter)
+	}
+	if want := []uint64{4}; !reflect.DeepEqual(s.SessionBuckets.Counters, want) {
+		t.Errorf("bucket counters = %v, want %v", s.SessionBuckets.Counters, want)
+	}
+}
+
+func TestMergeNearMaxInteger(t *testing.T) {
+	const maxIntegerSize = 18446744073709551615
+	tests := []struct {
+		name      string
+		value     uint64
+		overCount uint64
+		want      float64
+	}{
+		{name: "raw sum wraps", value: 18446744073709551610, want: 2 * maxIntegerSize},
+		{name: "wrapped before", value: 18446744073709551610, overCount: 1, want: 4 * maxIntegerSize},
+		{name: "small", value: 5, want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s, o Server
+			s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize = tt.value, tt.overCount, maxIntegerSize
+			o = s
+
+			s.merge(o)
+
+			if got := counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize); got != tt.want {
+				t.Errorf("merged requests = %g, want %g", got, tt.want)
+			}
+			// a third zone only adds to the total
+			s.merge(Server{RequestCounter: 1})
+			if got := counterValue(s.RequestCounter, s.OverCounts.RequestCounter, s.OverCounts.MaxIntegerSize); got < tt.want {
+				t.Errorf("merged requests went down to %g from %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectZoneFoldNearMaxInteger(t *testing.T) {
+	zone := `{"requestCounter": 18446744073709551610, "overCounts": {"maxIntegerSize": 18446744073709551615}}`
+	e := fixtureExporter(t, `{"serverZones": {"a": `+zone+`, "b": `+zone+`, "c": `+zone+`}}`)
+	filters, err := newZoneFilters(ZonesConfig{LimitAction: limitFold, Server: ZoneFilterConfig{Limit: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ZoneFilters = filters
+
+	lines := scrapeLines(t, e)
+	if want := `nginx_server_requests{code="total",host="__other__"} 3.6893488147419103e+19`; !slices.Contains(lines, want) {
+		t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+	}
+}
+
+func TestBucketsMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		b, o Buckets
+		want Buckets
+	}{
+		{
+			name: "same bounds",
+			b:    Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{1, 2}},
+			o:    Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{3, 4}},
+			want: Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{4, 6}},
+		},
+		{
+			name: "different bounds",
+			b:    Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{1, 2}},
+			o:    Buckets{Msecs: []uint64{10, 1000}, Counters: []uint64{3, 4}},
+		},
+		{
+			name: "missing counters",
+			b:    Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{1, 2}},
+			o:    Buckets{Msecs: []uint64{10, 100}, Counters: []uint64{3}},
+		},
+		{
+			name: "no buckets",
+			o:    Buckets{Msecs: []uint64{10}, Counters: []uint64{3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.b.merge(tt.o)
+			if !reflect.DeepEqual(tt.b, tt.want) {
+				t.Errorf("merge() = %+v, want %+v", tt.b, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectZoneLimit(t *testing.T) {
+	const status = `{"serverZones": {
+		"a": {"requestCounter": 1, "requestBuckets": {"msecs": [100], "counters": [1]}, "overCounts": {"maxIntegerSize": 100}},
+		"b": {"requestCounter": 2, "requestBuckets": {"msecs": [100], "counters": [2]}, "overCounts": {"maxIntegerSize": 100}},
+		"c": {"requestCounter": 3, "requestBuckets": {"msecs": [100], "counters": [3]}, "overCounts": {"maxIntegerSize": 100, "requestCounter": 1}},
+		"d": {"requestCounter": 4, "requestBuckets": {"msecs": [100], "counters": [4]}, "overCounts": {"maxIntegerSize": 100, "requestCounter": 2}},
+		"e": {"requestCounter": 5, "requestBuckets": {"msecs": [100], "counters": [5]}, "overCounts": {"maxIntegerSize": 100}}
+	}}`
+
+	tests := []struct {
+		action     string
+		want       []string
+		wantAbsent []string
+	}{
+		{
+			action: limitDrop,
+			want: []string{
+				`nginx_server_requests{code="total",host="a"} 1`,
+				`nginx_server_requests{code="total",host="b"} 2`,
+				`nginx_exporter_dropped_zones_total{kind="server"} 3`,
+				`nginx_exporter_cardinality_limited{kind="server"} 1`,
+			},
+			wantAbsent: []string{
+				`nginx_server_requests{code="total",host="c"}`,
+				`nginx_server_requests{code="total",host="__other__"}`,
+			},
+		},
+		{
+			action: limitFold,
+			want: []string{
+				`nginx_server_requests{code="total",host="a"} 1`,
+				`nginx_server_requests{code="total",host="b"} 2`,
+				// 3+4+5 plus 1+2 wraps of 100
+				`nginx_server_requests{code="total",host="__other__"} 312`,
+				`nginx_server_request_duration_seconds_bucket{host="__other__",le="0.1"} 12`,
+				`nginx_exporter_dropped_zones_total{kind="server"} 0`,
+				`nginx_exporter_cardinality_limited{kind="server"} 1`,
+			},
+			wantAbsent: []string{
+				`nginx_server_requests{code="total",host="c"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			filters, err := newZoneFilters(ZonesConfig{LimitAction: tt.action, Server: ZoneFilterConfig{Limit: 2}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := fixtureExporter(t, status)
+			e.ZoneFilters = filters
+			lines := scrapeLines(t, e)
+
+			for _, want := range tt.want {
+				if !hasSample(lines, want) {
+					t.Errorf("missing %s in\n%s", want, strings.Join(lines, "\n"))
+				}
+			}
+			for _, absent := range tt.wantAbsent {
+				if hasSample(lines, absent) {
+					t.Errorf("unexpected %s", absent)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectZoneLimitNotReached(t *testing.T) {
+	filters, err := newZoneFilters(ZonesConfig{LimitAction: limitFold, Server: ZoneFilterConfig{Limit: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fixtureExporter(t, `{"serverZones": {"a": {}, "b": {}}}`)
+	e.ZoneFilters = filters
+	lines := scrapeLines(t, e)
+
+	if !hasSample(lines, `nginx_exporter_cardinality_limited{kind="server"} 0`) {
+		t.Errorf("cardinality limited below the limit:\n%s", strings.Join(lines, "\n"))
+	}
+	if hasSample(lines, `nginx_server_requests{code="total",host="__other__"}`) {
+		t.Error("unexpected __other__ zone below the limit")
+	}
+}